@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+const (
+	pollModeCDC = "cdc"
+
+	defaultCDCSlotName       = "dynaproc"
+	defaultCDCPublication    = "dynaproc_purchase_orders"
+	defaultCDCStatusInterval = 10 * time.Second
+	defaultCDCReconnectDelay = 5 * time.Second
+
+	// duplicateObjectCode is the SQLSTATE returned when the replication slot
+	// already exists.
+	duplicateObjectCode = "42710"
+)
+
+// CaptureOrderChanges queues approved orders in the outbox as Postgres
+// streams their changes through the logical replication slot, until ctx is
+// cancelled. The stream is re-established after cfg.CDC.ReconnectDelay when
+// the replication connection fails.
+func CaptureOrderChanges(ctx context.Context, cfg Config) {
+	delay := cfg.CDC.ReconnectDelay
+	if delay <= 0 {
+		delay = defaultCDCReconnectDelay
+	}
+
+	for {
+		err := streamOrderChanges(ctx, cfg)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Order change stream failed, reconnecting", "slot", cdcSlotName(cfg), "retry_in", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// streamOrderChanges creates the replication slot if needed, queues orders
+// that were approved while nothing was streaming, and then consumes the slot
+// from the last confirmed position. Each transaction that approved orders is
+// queued together with its end position, so the server is only told to
+// discard WAL the outbox already reflects.
+func streamOrderChanges(ctx context.Context, cfg Config) error {
+	conn, err := pgconn.Connect(ctx, databaseDSN(cfg)+"&replication=database")
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	slot := cdcSlotName(cfg)
+	if err := ensureReplicationSlot(ctx, conn, slot); err != nil {
+		return err
+	}
+	start, err := loadCDCOffset(ctx, slot)
+	if err != nil {
+		return err
+	}
+
+	// changes from before the slot existed are not in the stream
+	for pollOnce(ctx, cfg) && ctx.Err() == nil {
+	}
+
+	err = pglogrepl.StartReplication(ctx, conn, slot, start, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", fmt.Sprintf("publication_names '%s'", cdcPublication(cfg))},
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Streaming purchase order changes", "slot", slot, "publication", cdcPublication(cfg), "start_lsn", start)
+
+	interval := cfg.CDC.StatusInterval
+	if interval <= 0 {
+		interval = defaultCDCStatusInterval
+	}
+	decoder := newCDCDecoder()
+	confirmed := start
+	var nextStatus time.Time
+
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: confirmed}); err != nil {
+				return err
+			}
+			health.RecordPoll()
+			recordPendingOrders(ctx)
+			nextStatus = time.Now().Add(interval)
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		raw, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return err
+		}
+
+		var data []byte
+		switch msg := raw.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("replication stream: %s (SQLSTATE %s)", msg.Message, msg.Code)
+		case *pgproto3.CopyData:
+			data = msg.Data
+		default:
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+			if err != nil {
+				return err
+			}
+			// everything before the server's position that concerns us has
+			// been received, so idle periods do not hold back WAL
+			if !decoder.inTransaction() && keepalive.ServerWALEnd > confirmed {
+				confirmed = keepalive.ServerWALEnd
+			}
+			if keepalive.ReplyRequested {
+				nextStatus = time.Time{}
+			}
+
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(data[1:])
+			if err != nil {
+				return err
+			}
+			logical, err := pglogrepl.Parse(xld.WALData)
+			if err != nil {
+				return err
+			}
+			commit := decoder.apply(logical)
+			if commit == nil {
+				continue
+			}
+			if len(commit.OrderIDs) > 0 {
+				orders, err := commitOrderChanges(ctx, cfg, slot, *commit)
+				if err != nil {
+					return err
+				}
+				if len(orders) > 0 {
+					recordQueuedOrders(orders)
+				}
+			}
+			confirmed = commit.LSN
+		}
+	}
+}
+
+// ensureReplicationSlot creates the pgoutput slot unless it already exists.
+func ensureReplicationSlot(ctx context.Context, conn *pgconn.PgConn, slot string) error {
+	_, err := pglogrepl.CreateReplicationSlot(ctx, conn, slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{Mode: pglogrepl.LogicalReplication})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == duplicateObjectCode {
+		return nil
+	}
+	if err == nil {
+		slog.Info("Created replication slot", "slot", slot)
+	}
+	return err
+}
+
+// cdcCommit is a committed transaction and the orders it may have approved.
+type cdcCommit struct {
+	LSN      pglogrepl.LSN
+	OrderIDs []string
+}
+
+// cdcDecoder follows the pgoutput stream and collects, per transaction, the
+// orders whose row ended up waiting to be synced, because it was approved,
+// amended or cancelled, or whose lines changed. The claim re-checks the
+// orders, so a line change on an order that is not pending costs a query and
+// nothing else.
+type cdcDecoder struct {
+	relations map[uint32]*pglogrepl.RelationMessage
+	touched   map[string]bool
+	inTxn     bool
+}
+
+func newCDCDecoder() *cdcDecoder {
+	return &cdcDecoder{
+		relations: map[uint32]*pglogrepl.RelationMessage{},
+		touched:   map[string]bool{},
+	}
+}
+
+func (d *cdcDecoder) inTransaction() bool {
+	return d.inTxn
+}
+
+// apply records one logical replication message and returns the transaction
+// once its commit arrives.
+func (d *cdcDecoder) apply(msg pglogrepl.Message) *cdcCommit {
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		d.relations[msg.RelationID] = msg
+	case *pglogrepl.BeginMessage:
+		d.inTxn = true
+	case *pglogrepl.InsertMessage:
+		d.touch(msg.RelationID, msg.Tuple)
+	case *pglogrepl.UpdateMessage:
+		d.touch(msg.RelationID, msg.NewTuple)
+	case *pglogrepl.CommitMessage:
+		var ids []string
+		for id, pending := range d.touched {
+			if pending {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		d.touched = map[string]bool{}
+		d.inTxn = false
+		return &cdcCommit{LSN: msg.TransactionEndLSN, OrderIDs: ids}
+	}
+	return nil
+}
+
+// touch notes the order a row change belongs to. The last change to an order
+// row within the transaction decides whether it is pending.
+func (d *cdcDecoder) touch(relationID uint32, tuple *pglogrepl.TupleData) {
+	rel, ok := d.relations[relationID]
+	if !ok || tuple == nil {
+		return
+	}
+	values := tupleValues(rel, tuple)
+
+	switch rel.RelationName {
+	case "purchase_orders":
+		if id, ok := values["id"]; ok {
+			d.touched[id] = values["sync_status"] == SyncStatusPending &&
+				(values["status"] == "APPROVED" || values["sync_action"] == SyncActionCancel)
+		}
+	case "purchase_order_lines":
+		if id, ok := values["purchase_order_id"]; ok {
+			if _, seen := d.touched[id]; !seen {
+				d.touched[id] = true
+			}
+		}
+	}
+}
+
+// tupleValues maps the relation's column names to the tuple's text values.
+// NULL and unchanged TOAST columns are left out.
+func tupleValues(rel *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) map[string]string {
+	values := make(map[string]string, len(tuple.Columns))
+	for i, col := range tuple.Columns {
+		if i >= len(rel.Columns) || col.DataType != pglogrepl.TupleDataTypeText {
+			continue
+		}
+		values[rel.Columns[i].Name] = string(col.Data)
+	}
+	return values
+}
+
+// commitOrderChanges claims the transaction's pending orders, queues them in
+// the outbox and records the transaction's end position, all in one database
+// transaction. If it fails nothing is confirmed to the server, which sends
+// the changes again when the stream is re-established.
+func commitOrderChanges(ctx context.Context, cfg Config, slot string, commit cdcCommit) ([]PurchaseOrder, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	orders, err := FetchOrdersByID(ctx, tx, cfg, commit.OrderIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) > 0 {
+		if err := queueOrders(ctx, tx, cfg, orders); err != nil {
+			return nil, err
+		}
+	}
+	if err := saveCDCOffset(ctx, tx, slot, commit.LSN); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// loadCDCOffset returns the last position confirmed for the slot, or zero to
+// let the server resume from the slot's own position.
+func loadCDCOffset(ctx context.Context, slot string) (pglogrepl.LSN, error) {
+	var lsn string
+	err := db.QueryRowContext(ctx, "SELECT confirmed_lsn FROM cdc_offsets WHERE slot_name = $1", slot).Scan(&lsn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return pglogrepl.ParseLSN(lsn)
+}
+
+func saveCDCOffset(ctx context.Context, q dbQuerier, slot string, lsn pglogrepl.LSN) error {
+	_, err := q.ExecContext(ctx, `INSERT INTO cdc_offsets (slot_name, confirmed_lsn, updated_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (slot_name) DO UPDATE SET confirmed_lsn = EXCLUDED.confirmed_lsn, updated_at = EXCLUDED.updated_at`, slot, lsn.String())
+	return err
+}
+
+func cdcSlotName(cfg Config) string {
+	if cfg.CDC.SlotName != "" {
+		return cfg.CDC.SlotName
+	}
+	return defaultCDCSlotName
+}
+
+func cdcPublication(cfg Config) string {
+	if cfg.CDC.Publication != "" {
+		return cfg.CDC.Publication
+	}
+	return defaultCDCPublication
+}
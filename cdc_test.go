@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pglogrepl"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// claimOrdersByIDQuery matches the statement FetchOrdersByID claims orders with.
+// It must neither skip locked rows nor respect leases.
+const claimOrdersByIDQuery = `UPDATE purchase_orders SET claimed_by = \$1, claimed_until = NOW\(\) \+ \$2 \* INTERVAL '1 second'\s+WHERE id IN \(\s+SELECT id FROM purchase_orders\s+WHERE id = ANY\(\$3\) AND sync_status = 'pending' AND \(status = 'APPROVED' OR sync_action = 'cancel'\)\s+ORDER BY id\s+FOR UPDATE\s+\)`
+
+func relation(id uint32, name string, columns ...string) *pglogrepl.RelationMessage {
+	rel := &pglogrepl.RelationMessage{RelationID: id, Namespace: "public", RelationName: name}
+	for _, col := range columns {
+		rel.Columns = append(rel.Columns, &pglogrepl.RelationMessageColumn{Name: col})
+	}
+	return rel
+}
+
+func tuple(values ...string) *pglogrepl.TupleData {
+	data := &pglogrepl.TupleData{}
+	for _, v := range values {
+		data.Columns = append(data.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeText, Data: []byte(v)})
+	}
+	return data
+}
+
+func TestCDCDecoder(t *testing.T) {
+	orders := relation(1, "purchase_orders", "id", "vendor_id", "status", "sync_status", "sync_action")
+	lines := relation(2, "purchase_order_lines", "purchase_order_id", "line_number")
+	other := relation(3, "vendors", "id", "status")
+
+	// Test case 1: Approved pending orders and changed lines are collected until the commit
+	t.Run("Collect pending orders", func(t *testing.T) {
+		d := newCDCDecoder()
+		for _, rel := range []*pglogrepl.RelationMessage{orders, lines, other} {
+			assert.Nil(t, d.apply(rel))
+		}
+
+		assert.Nil(t, d.apply(&pglogrepl.BeginMessage{}))
+		assert.True(t, d.inTransaction())
+		assert.Nil(t, d.apply(&pglogrepl.InsertMessage{RelationID: 1, Tuple: tuple("PO002", "V001", "APPROVED", "pending", "create")}))
+		assert.Nil(t, d.apply(&pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("PO003", "V001", "DRAFT", "pending", "create")}))
+		assert.Nil(t, d.apply(&pglogrepl.InsertMessage{RelationID: 2, Tuple: tuple("PO001", "1")}))
+		assert.Nil(t, d.apply(&pglogrepl.InsertMessage{RelationID: 3, Tuple: tuple("V001", "APPROVED")}))
+
+		commit := d.apply(&pglogrepl.CommitMessage{CommitLSN: 100, TransactionEndLSN: 120})
+		assert.Equal(t, &cdcCommit{LSN: 120, OrderIDs: []string{"PO001", "PO002"}}, commit)
+		assert.False(t, d.inTransaction())
+	})
+
+	// Test case 2: The last change to an order within a transaction wins
+	t.Run("Later change supersedes", func(t *testing.T) {
+		d := newCDCDecoder()
+		d.apply(orders)
+		d.apply(lines)
+
+		d.apply(&pglogrepl.BeginMessage{})
+		d.apply(&pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("PO001", "V001", "APPROVED", "pending", "create")})
+		d.apply(&pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("PO001", "V001", "APPROVED", "queued", "create")})
+		d.apply(&pglogrepl.InsertMessage{RelationID: 2, Tuple: tuple("PO001", "2")})
+
+		commit := d.apply(&pglogrepl.CommitMessage{TransactionEndLSN: 200})
+		assert.Equal(t, pglogrepl.LSN(200), commit.LSN)
+		assert.Empty(t, commit.OrderIDs)
+	})
+
+	// Test case 3: Changes to relations not yet described are ignored
+	t.Run("Unknown relation", func(t *testing.T) {
+		d := newCDCDecoder()
+		d.apply(&pglogrepl.BeginMessage{})
+		d.apply(&pglogrepl.InsertMessage{RelationID: 1, Tuple: tuple("PO001", "V001", "APPROVED", "pending", "create")})
+
+		commit := d.apply(&pglogrepl.CommitMessage{TransactionEndLSN: 300})
+		assert.Empty(t, commit.OrderIDs)
+	})
+
+	// Test case 4: Cancelled orders waiting to be synced are collected
+	t.Run("Collect cancelled orders", func(t *testing.T) {
+		d := newCDCDecoder()
+		d.apply(orders)
+
+		d.apply(&pglogrepl.BeginMessage{})
+		d.apply(&pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("PO001", "V001", "CANCELLED", "pending", "cancel")})
+		d.apply(&pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("PO002", "V001", "CANCELLED", "synced", "create")})
+		d.apply(&pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("PO003", "V001", "APPROVED", "pending", "update")})
+
+		commit := d.apply(&pglogrepl.CommitMessage{TransactionEndLSN: 400})
+		assert.Equal(t, []string{"PO001", "PO003"}, commit.OrderIDs)
+	})
+}
+
+func TestCommitOrderChanges(t *testing.T) {
+	commit := cdcCommit{LSN: 0x16B3748, OrderIDs: []string{"PO001", "PO002"}}
+
+	// Test case 1: Claimed orders are queued together with the stream position
+	t.Run("Queue orders and save offset", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersByIDQuery).
+			WithArgs(instanceID, defaultClaimLease.Seconds(), pq.Array(commit.OrderIDs)).
+			WillReturnRows(sqlmock.NewRows(orderColumns).AddRow("PO001", "V001", "100.50", "USD", SyncActionCreate, 1))
+		mock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+		mock.ExpectExec("INSERT INTO outbox").
+			WithArgs("PO001", eventOrderApproved, envelopeArg{eventOrderApproved, "PO001"}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs(pq.Array([]string{"PO001"}), SyncStatusQueued).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO cdc_offsets").
+			WithArgs("dynaproc", "0/16B3748").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		orders, err := commitOrderChanges(context.Background(), Config{}, "dynaproc", commit)
+		assert.NoError(t, err)
+		assert.Len(t, orders, 1)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: The position advances even when no order is still pending
+	t.Run("Nothing to claim", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersByIDQuery).WillReturnRows(sqlmock.NewRows(orderColumns))
+		mock.ExpectExec("INSERT INTO cdc_offsets").
+			WithArgs("dynaproc", "0/16B3748").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		orders, err := commitOrderChanges(context.Background(), Config{}, "dynaproc", commit)
+		assert.NoError(t, err)
+		assert.Empty(t, orders)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 3: A failed offset write rolls back the queued orders
+	t.Run("Rollback on failure", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersByIDQuery).WillReturnRows(sqlmock.NewRows(orderColumns))
+		mock.ExpectExec("INSERT INTO cdc_offsets").WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+
+		orders, err := commitOrderChanges(context.Background(), Config{}, "dynaproc", commit)
+		assert.Error(t, err)
+		assert.Nil(t, orders)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestLoadCDCOffset(t *testing.T) {
+	// Test case 1: A stored position is resumed from
+	t.Run("Stored offset", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT confirmed_lsn FROM cdc_offsets").
+			WithArgs("dynaproc").
+			WillReturnRows(sqlmock.NewRows([]string{"confirmed_lsn"}).AddRow("0/16B3748"))
+
+		lsn, err := loadCDCOffset(context.Background(), "dynaproc")
+		assert.NoError(t, err)
+		assert.Equal(t, pglogrepl.LSN(0x16B3748), lsn)
+	})
+
+	// Test case 2: A new slot starts from its own position
+	t.Run("No offset", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT confirmed_lsn FROM cdc_offsets").
+			WillReturnRows(sqlmock.NewRows([]string{"confirmed_lsn"}))
+
+		lsn, err := loadCDCOffset(context.Background(), "dynaproc")
+		assert.NoError(t, err)
+		assert.Zero(t, lsn)
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("dynamics circuit breaker is open")
+
+var dynamicsBreaker *CircuitBreaker
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// CircuitBreaker stops calls to Dynamics after threshold consecutive failures
+// that point at Dynamics itself being unavailable. Once open it rejects calls
+// for the cooldown, then lets a single probe through (half-open); the probe's
+// outcome closes the breaker again or re-opens it for another cooldown.
+// All methods are no-ops on a nil breaker.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	// onOpen is called in its own goroutine when the closed breaker opens, so
+	// a slow report never holds up the worker that tripped it. A failed probe
+	// re-opening it is not reported again.
+	onOpen func(err error)
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// changed is closed and replaced on every state change.
+	changed chan struct{}
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		changed:   make(chan struct{}),
+	}
+}
+
+// Allow returns errCircuitOpen when a call must not be made now. After the
+// cooldown it admits one probe at a time; the caller must Record its outcome.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen {
+		if b.now().Before(b.openedAt.Add(b.cooldown)) {
+			return errCircuitOpen
+		}
+		b.setState(circuitHalfOpen, nil)
+	}
+	if b.state == circuitHalfOpen {
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call. Any answer from Dynamics
+// other than a 5xx or 429 shows it is reachable and counts as a success;
+// errors that say nothing about Dynamics, such as a cancelled context or a
+// failed database update, only end a half-open probe.
+func (b *CircuitBreaker) Record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	opened := false
+	defer func() {
+		b.mu.Unlock()
+		if opened && b.onOpen != nil {
+			go b.onOpen(err)
+		}
+	}()
+	b.endProbe()
+
+	var apiErr *DynamicsAPIError
+	switch {
+	case err == nil, errors.As(err, &apiErr) && !tripsBreaker(err):
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.setState(circuitClosed, nil)
+		}
+	case tripsBreaker(err):
+		b.failures++
+		if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+			opened = b.state == circuitClosed
+			b.openedAt = b.now()
+			b.setState(circuitOpen, err)
+		}
+	}
+}
+
+// Release ends an allowed call that was abandoned before reaching Dynamics,
+// without counting it either way, so the next call can probe in its place.
+func (b *CircuitBreaker) Release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endProbe()
+}
+
+// endProbe frees the half-open probe slot and wakes callers waiting for it.
+func (b *CircuitBreaker) endProbe() {
+	if !b.probing {
+		return
+	}
+	b.probing = false
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Wait blocks while calls would be rejected, returning once the breaker is
+// closed or ready for a probe, or with ctx's error when ctx is done first.
+func (b *CircuitBreaker) Wait(ctx context.Context) error {
+	if b == nil {
+		return ctx.Err()
+	}
+
+	for {
+		b.mu.Lock()
+		state, probing, changed := b.state, b.probing, b.changed
+		remaining := b.openedAt.Add(b.cooldown).Sub(b.now())
+		b.mu.Unlock()
+
+		if state == circuitClosed || state == circuitHalfOpen && !probing || state == circuitOpen && remaining <= 0 {
+			return ctx.Err()
+		}
+
+		// while a probe is in flight only a state change can end the wait
+		timer := time.NewTimer(remaining)
+		if state != circuitOpen {
+			timer.Stop()
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (b *CircuitBreaker) setState(state circuitState, cause error) {
+	from := b.state
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+	dynamicsCircuitState.Set(float64(state))
+
+	switch state {
+	case circuitOpen:
+		slog.Error("Dynamics circuit breaker opened, pausing calls", "from", from.String(), "cooldown", b.cooldown, "failures", b.failures, "error", cause)
+	case circuitHalfOpen:
+		slog.Info("Dynamics circuit breaker half-open, probing")
+	case circuitClosed:
+		slog.Info("Dynamics circuit breaker closed, resuming calls", "from", from.String())
+	}
+}
+
+// tripsBreaker reports whether err suggests Dynamics as a whole is unavailable
+// rather than that one order was rejected.
+func tripsBreaker(err error) bool {
+	switch failureClass(err) {
+	case failureNetwork, failureTimeout, failureDynamics5xx, failureThrottled:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// useCircuitBreaker installs a breaker with a controllable clock for the
+// duration of the test.
+func useCircuitBreaker(t *testing.T, threshold int, cooldown time.Duration) (*CircuitBreaker, *time.Time) {
+	original := dynamicsBreaker
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	dynamicsBreaker = NewCircuitBreaker(threshold, cooldown)
+	dynamicsBreaker.now = func() time.Time { return now }
+	t.Cleanup(func() {
+		dynamicsBreaker = original
+		dynamicsCircuitState.Set(float64(circuitClosed))
+	})
+	return dynamicsBreaker, &now
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	unavailable := &DynamicsAPIError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	rejected := &DynamicsAPIError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}
+
+	// Test case 1: Consecutive failures open the breaker at the threshold
+	t.Run("Opens after threshold failures", func(t *testing.T) {
+		breaker, _ := useCircuitBreaker(t, 3, time.Minute)
+		opened := make(chan error, 1)
+		release := make(chan struct{})
+		breaker.onOpen = func(err error) {
+			<-release
+			opened <- err
+		}
+
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, breaker.Allow())
+			breaker.Record(unavailable)
+		}
+		assert.NoError(t, breaker.Allow(), "breaker must stay closed below the threshold")
+		breaker.Record(unavailable)
+
+		assert.ErrorIs(t, breaker.Allow(), errCircuitOpen)
+		assert.Equal(t, float64(circuitOpen), testutil.ToFloat64(dynamicsCircuitState))
+
+		// Record returned while the report was still blocked
+		close(release)
+		select {
+		case err := <-opened:
+			assert.ErrorIs(t, err, unavailable)
+		case <-time.After(time.Second):
+			t.Fatal("opening was not reported")
+		}
+	})
+
+	// Test case 2: Rejections and successes reset the failure count
+	t.Run("Client errors do not trip", func(t *testing.T) {
+		breaker, _ := useCircuitBreaker(t, 2, time.Minute)
+
+		breaker.Record(unavailable)
+		breaker.Record(rejected)
+		breaker.Record(unavailable)
+		breaker.Record(nil)
+		breaker.Record(unavailable)
+		breaker.Record(errors.New("database is down"))
+
+		assert.NoError(t, breaker.Allow())
+	})
+
+	// Test case 3: After the cooldown a single probe is admitted and closes the breaker
+	t.Run("Successful probe closes", func(t *testing.T) {
+		breaker, now := useCircuitBreaker(t, 1, time.Minute)
+		breaker.Record(unavailable)
+		assert.ErrorIs(t, breaker.Allow(), errCircuitOpen)
+
+		*now = now.Add(time.Minute)
+		assert.NoError(t, breaker.Allow(), "first call after the cooldown is the probe")
+		assert.ErrorIs(t, breaker.Allow(), errCircuitOpen, "only one probe at a time")
+		assert.Equal(t, float64(circuitHalfOpen), testutil.ToFloat64(dynamicsCircuitState))
+
+		breaker.Record(nil)
+		assert.NoError(t, breaker.Allow())
+		assert.NoError(t, breaker.Allow())
+		assert.Equal(t, float64(circuitClosed), testutil.ToFloat64(dynamicsCircuitState))
+	})
+
+	// Test case 4: A failed probe re-opens the breaker for another cooldown
+	t.Run("Failed probe reopens", func(t *testing.T) {
+		breaker, now := useCircuitBreaker(t, 1, time.Minute)
+		opened := make(chan error, 2)
+		breaker.onOpen = func(err error) { opened <- err }
+
+		breaker.Record(unavailable)
+		*now = now.Add(time.Minute)
+		assert.NoError(t, breaker.Allow())
+		breaker.Record(context.DeadlineExceeded)
+
+		assert.ErrorIs(t, breaker.Allow(), errCircuitOpen)
+		*now = now.Add(30 * time.Second)
+		assert.ErrorIs(t, breaker.Allow(), errCircuitOpen, "cooldown restarts when the probe fails")
+		select {
+		case <-opened:
+		case <-time.After(time.Second):
+			t.Fatal("opening was not reported")
+		}
+		assert.Empty(t, opened, "only the first opening is reported")
+	})
+
+	// Test case 5: A probe that never reached Dynamics frees the slot for another
+	t.Run("Neutral probe outcome", func(t *testing.T) {
+		breaker, now := useCircuitBreaker(t, 1, time.Minute)
+		breaker.Record(unavailable)
+		*now = now.Add(time.Minute)
+
+		assert.NoError(t, breaker.Allow())
+		breaker.Record(context.Canceled)
+		assert.NoError(t, breaker.Allow())
+		assert.Equal(t, float64(circuitHalfOpen), testutil.ToFloat64(dynamicsCircuitState))
+	})
+
+	// Test case 6: A released probe frees the slot for another
+	t.Run("Released probe", func(t *testing.T) {
+		breaker, now := useCircuitBreaker(t, 1, time.Minute)
+		breaker.Record(unavailable)
+		*now = now.Add(time.Minute)
+
+		assert.NoError(t, breaker.Allow())
+		assert.ErrorIs(t, breaker.Allow(), errCircuitOpen)
+		breaker.Release()
+		assert.NoError(t, breaker.Allow())
+	})
+
+	// Test case 7: A nil breaker lets every call through
+	t.Run("Nil breaker", func(t *testing.T) {
+		var breaker *CircuitBreaker
+		assert.NoError(t, breaker.Allow())
+		breaker.Release()
+		breaker.Record(unavailable)
+		assert.NoError(t, breaker.Wait(context.Background()))
+	})
+}
+
+func TestCircuitBreakerWait(t *testing.T) {
+	unavailable := &DynamicsAPIError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+
+	// Test case 1: Wait returns once the cooldown has elapsed
+	t.Run("Waits out the cooldown", func(t *testing.T) {
+		breaker := NewCircuitBreaker(1, 30*time.Millisecond)
+		breaker.Record(unavailable)
+
+		start := time.Now()
+		assert.NoError(t, breaker.Wait(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 25*time.Millisecond)
+		assert.NoError(t, breaker.Allow())
+		breaker.Record(nil)
+	})
+
+	// Test case 2: Wait blocks while a probe is in flight and returns when it closes the breaker
+	t.Run("Waits for the probe", func(t *testing.T) {
+		breaker, now := useCircuitBreaker(t, 1, time.Minute)
+		breaker.Record(unavailable)
+		*now = now.Add(time.Minute)
+		assert.NoError(t, breaker.Allow())
+
+		done := make(chan error, 1)
+		go func() { done <- breaker.Wait(context.Background()) }()
+
+		select {
+		case <-done:
+			t.Fatal("Wait returned while the probe was in flight")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		breaker.Record(nil)
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not return after the breaker closed")
+		}
+	})
+
+	// Test case 3: Wait returns when the probe is abandoned
+	t.Run("Waits for a released probe", func(t *testing.T) {
+		breaker, now := useCircuitBreaker(t, 1, time.Minute)
+		breaker.Record(unavailable)
+		*now = now.Add(time.Minute)
+		assert.NoError(t, breaker.Allow())
+
+		done := make(chan error, 1)
+		go func() { done <- breaker.Wait(context.Background()) }()
+		time.Sleep(20 * time.Millisecond)
+
+		breaker.Release()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not return after the probe was released")
+		}
+	})
+
+	// Test case 4: Wait gives up when the context is cancelled
+	t.Run("Context cancelled", func(t *testing.T) {
+		breaker, _ := useCircuitBreaker(t, 1, time.Hour)
+		breaker.Record(unavailable)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, breaker.Wait(ctx), context.DeadlineExceeded)
+	})
+}
+
+func TestSyncToDynamicsCircuitBreaker(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	useDynamicsThrottle(t, Dynamics365Config{MaxThrottleRetries: -1})
+	useCircuitBreaker(t, 1, time.Minute)
+	mock := setupMockDB(t)
+	expectMarkSyncing(mock, "PO123", "")
+	mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+		WithArgs("PO123", SyncStatusFailed, sqlmock.AnyArg(), "", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL}}
+	po := PurchaseOrder{ID: "PO123", VendorID: "V001", Amount: decimal.RequireFromString("10"), Currency: "USD"}
+
+	err := SyncToDynamics(context.Background(), cfg, po)
+	assert.Error(t, err)
+
+	// the open breaker rejects the order without touching the database or Dynamics
+	err = SyncToDynamics(context.Background(), cfg, po)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, failureCircuitOpen, failureClass(err))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSyncToDynamicsStaleEventReleasesProbe(t *testing.T) {
+	breaker, now := useCircuitBreaker(t, 1, time.Minute)
+	breaker.Record(&DynamicsAPIError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"})
+	*now = now.Add(time.Minute)
+
+	mock := setupMockDB(t)
+	mock.ExpectQuery(markSyncingQuery).
+		WithArgs("PO123", SyncStatusSyncing, int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"dynamics_id", "dynamics_etag"}))
+
+	// the stale event is admitted as the half-open probe and must give the slot back
+	err := SyncToDynamics(context.Background(), Config{}, PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2})
+	assert.ErrorIs(t, err, errStaleEvent)
+	assert.NoError(t, breaker.Allow())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -4,42 +4,160 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	AppName     string
-	AppVersion  string
-	Environment string
-	Database    DatabaseConfig
-	RabbitMQ    RabbitMQConfig
-	Dynamics365 Dynamics365Config
-	GlitchTip   GlitchTipConfig
+	AppName      string
+	AppVersion   string
+	Environment  string
+	DrainTimeout time.Duration
+	Log          LogConfig
+	HTTP         HTTPConfig
+	Poll         PollConfig
+	Outbox       OutboxConfig
+	CDC          CDCConfig
+	Ledger       LedgerConfig
+	Leader       LeaderConfig
+	Database     DatabaseConfig
+	RabbitMQ     RabbitMQConfig
+	Dynamics365  Dynamics365Config
+	GlitchTip    GlitchTipConfig
+}
+
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+type HTTPConfig struct {
+	Address        string
+	PollStaleAfter time.Duration
+}
+
+// PollConfig selects how pending orders are discovered. In "interval" mode
+// they are fetched every Interval; in "notify" mode they are fetched whenever
+// Postgres signals an approval, with a sweep every SweepInterval to catch
+// notifications missed while the listener was disconnected; in "cdc" mode they
+// are read from a logical replication slot, see CDCConfig. Each fetch claims
+// at most BatchSize orders for LeaseDuration.
+type PollConfig struct {
+	Mode          string
+	Interval      time.Duration
+	SweepInterval time.Duration
+	BatchSize     int
+	LeaseDuration time.Duration
+}
+
+// OutboxConfig controls the relay that publishes outbox rows. It publishes as
+// soon as the poller queues orders and otherwise every RelayInterval. A row
+// that fails to publish is retried after RetryDelay, doubling per attempt up
+// to MaxRetryDelay.
+type OutboxConfig struct {
+	RelayInterval time.Duration
+	BatchSize     int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// CDCConfig controls the logical replication stream used in "cdc" poll mode.
+// The slot is created on first start and decodes Publication with pgoutput;
+// the confirmed position is reported to Postgres every StatusInterval.
+type CDCConfig struct {
+	SlotName       string
+	Publication    string
+	StatusInterval time.Duration
+	ReconnectDelay time.Duration
+}
+
+// LedgerConfig controls the idempotency ledger of processed message IDs.
+// Entries are kept for Retention and pruned every PruneInterval.
+type LedgerConfig struct {
+	Retention     time.Duration
+	PruneInterval time.Duration
+}
+
+// LeaderConfig controls the advisory-lock election that decides which instance
+// runs the poller. Every instance consumes from RabbitMQ regardless.
+type LeaderConfig struct {
+	Enabled       bool
+	RenewInterval time.Duration
+	RetryInterval time.Duration
 }
 
 type DatabaseConfig struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	Name     string
-	SSLMode  string
+	Host        string
+	Port        int
+	User        string
+	Password    string
+	Name        string
+	SSLMode     string
+	AutoMigrate bool
 }
 
 type RabbitMQConfig struct {
-	URL string
+	URL               string
+	MaxRetries        int
+	RetryDelay        time.Duration
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	ConfirmTimeout    time.Duration
+
+	// Workers is the number of deliveries handled concurrently and Prefetch
+	// the number of unacknowledged deliveries the broker sends ahead.
+	Workers  int
+	Prefetch int
 }
 
 type Dynamics365Config struct {
-	APIURL string
+	APIURL          string
+	LinesURL        string
+	TenantID        string
+	ClientID        string
+	ClientSecret    string
+	CertificatePath string
+	Scope           string
+	TokenURL        string
+
+	// CancelAction is the bound OData action invoked on a header to cancel it.
+	CancelAction string
+
+	// Client-side limits, see DynamicsThrottle. MaxThrottleRetries of -1
+	// disables retrying throttled requests.
+	RequestsPerSecond     float64
+	Burst                 int
+	MaxConcurrentRequests int
+	MaxThrottleRetries    int
+	MaxRetryAfter         time.Duration
+
+	// Consecutive failures that open the circuit breaker, and how long it
+	// stays open before probing Dynamics again.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
 }
 
 type GlitchTipConfig struct {
-	APIURL string
+	DSN string
 }
 
 func (c *Config) LoadConfig(path string) {
+	c.loadConfig(path, func(string) bool { return true })
+}
+
+// LoadDatabaseConfig loads only the top-level, log and database settings, for
+// the migrate and conflicts commands, which must run without the environment
+// variables only the service needs.
+func (c *Config) LoadDatabaseConfig(path string) {
+	c.loadConfig(path, func(key string) bool {
+		return !strings.Contains(key, ".") || strings.HasPrefix(key, "log.") || strings.HasPrefix(key, "database.")
+	})
+}
+
+// loadConfig reads the config file, expands the "${VAR:default}" values of the
+// keys include selects and unmarshals those keys alone into c.
+func (c *Config) loadConfig(path string, include func(key string) bool) {
 	viper.AddConfigPath(".")
 	viper.SetConfigName(path)
 
@@ -49,14 +167,19 @@ func (c *Config) LoadConfig(path string) {
 		os.Exit(1)
 	}
 
+	settings := viper.New()
 	for _, k := range viper.AllKeys() {
-		value := viper.GetString(k)
-		if strings.HasPrefix(value, "${") && strings.HasSuffix(value, "}") {
-			viper.Set(k, getEnvOrPanic(strings.TrimSuffix(strings.TrimPrefix(value, "${"), "}")))
+		if !include(k) {
+			continue
+		}
+		value := viper.Get(k)
+		if s, ok := value.(string); ok && strings.HasPrefix(s, "${") && strings.HasSuffix(s, "}") {
+			value = getEnvOrPanic(strings.TrimSuffix(strings.TrimPrefix(s, "${"), "}"))
 		}
+		settings.Set(k, value)
 	}
 
-	err = viper.Unmarshal(c)
+	err = settings.Unmarshal(c)
 	if err != nil {
 		fmt.Println("fatal error config file: default \n", err)
 		os.Exit(1)
@@ -68,11 +191,10 @@ func getEnvOrPanic(env string) string {
 	res := os.Getenv(split[0])
 	if len(res) == 0 {
 		if len(split) > 1 {
-			res = strings.Join(split[1:], ":")
-		}
-		if len(res) == 0 {
-			panic("Mandatory env variable not found:" + env)
+			// "${VAR:}" marks an optional variable with an empty default
+			return strings.Join(split[1:], ":")
 		}
+		panic("Mandatory env variable not found:" + env)
 	}
 	return res
 }
@@ -1,17 +1,53 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultClaimBatchSize = 100
+	defaultClaimLease     = 2 * time.Minute
 )
 
 var db *sql.DB
 
+// dbQuerier is satisfied by both *sql.DB and *sql.Tx, so queries can run
+// inside or outside a transaction.
+type dbQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// instanceID identifies this process in the claimed_by column.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "dynaproc"
+	}
+	return host + "-" + newRandomID()[:8]
+}
+
 func InitDB(cfg Config) {
-	dsn := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
+	var err error
+	db, err = sql.Open("postgres", databaseDSN(cfg))
+	if err != nil {
+		fatal("Failed to open database", err)
+	}
+}
+
+func databaseDSN(cfg Config) string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
 		cfg.Database.User,
 		cfg.Database.Password,
 		cfg.Database.Host,
@@ -19,28 +55,250 @@ func InitDB(cfg Config) {
 		cfg.Database.Name,
 		cfg.Database.SSLMode,
 	)
-	var err error
-	db, err = sql.Open("postgres", dsn)
+}
+
+func CloseDB() {
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
+}
+
+// FetchPendingOrders claims up to cfg.Poll.BatchSize orders with a change
+// waiting to be sent, that is approved orders and cancelled ones whose
+// cancellation is pending, for this instance and returns them. Rows locked or
+// leased by another instance are skipped, so concurrent instances split the
+// work; a lease that expired because its instance crashed before queueing the
+// order is claimed again.
+func FetchPendingOrders(ctx context.Context, q dbQuerier, cfg Config) ([]PurchaseOrder, error) {
+	rows, err := q.QueryContext(ctx, `UPDATE purchase_orders SET claimed_by = $1, claimed_until = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM purchase_orders
+			WHERE sync_status = 'pending' AND (status = 'APPROVED' OR sync_action = 'cancel') AND (claimed_until IS NULL OR claimed_until < NOW())
+			ORDER BY id LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, vendor_id, amount, currency, sync_action, sync_version`, instanceID, claimLease(cfg).Seconds(), claimBatchSize(cfg))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return scanClaimedOrders(ctx, q, rows)
 }
 
-func FetchPendingOrders() ([]PurchaseOrder, error) {
-	rows, err := db.Query("SELECT id, vendor_id, amount, currency FROM purchase_orders WHERE status = 'APPROVED' AND synced = FALSE")
+// FetchOrdersByID claims those of the given orders that have a change waiting
+// to be sent. Unlike FetchPendingOrders it waits for rows another transaction
+// has locked and disregards leases: the change stream moves past the orders
+// once this returns, so an order skipped here would not be seen again. Rows
+// are locked in id order, like the poller's claim, and re-checked once the lock
+// is held, so an order the poller queued meanwhile is not queued twice.
+func FetchOrdersByID(ctx context.Context, q dbQuerier, cfg Config, poIDs []string) ([]PurchaseOrder, error) {
+	rows, err := q.QueryContext(ctx, `UPDATE purchase_orders SET claimed_by = $1, claimed_until = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM purchase_orders
+			WHERE id = ANY($3) AND sync_status = 'pending' AND (status = 'APPROVED' OR sync_action = 'cancel')
+			ORDER BY id
+			FOR UPDATE
+		)
+		RETURNING id, vendor_id, amount, currency, sync_action, sync_version`, instanceID, claimLease(cfg).Seconds(), pq.Array(poIDs))
 	if err != nil {
 		return nil, err
 	}
+	return scanClaimedOrders(ctx, q, rows)
+}
+
+// CountPendingOrders returns the number of orders with a change waiting to be
+// queued, whether or not an instance has claimed them.
+func CountPendingOrders(ctx context.Context) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM purchase_orders WHERE sync_status = 'pending' AND (status = 'APPROVED' OR sync_action = 'cancel')").Scan(&count)
+	return count, err
+}
+
+// scanClaimedOrders reads the orders returned by a claim and loads their lines.
+func scanClaimedOrders(ctx context.Context, q dbQuerier, rows *sql.Rows) ([]PurchaseOrder, error) {
 	defer rows.Close()
 
 	var orders []PurchaseOrder
 	for rows.Next() {
 		var po PurchaseOrder
-		err := rows.Scan(&po.ID, &po.VendorID, &po.Amount, &po.Currency)
+		err := rows.Scan(&po.ID, &po.VendorID, &po.Amount, &po.Currency, &po.Action, &po.Version)
 		if err != nil {
 			return nil, err
 		}
+		po.CorrelationID = newRandomID()
 		orders = append(orders, po)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := loadOrderLines(ctx, q, orders); err != nil {
+		return nil, err
+	}
 	return orders, nil
 }
+
+func claimLease(cfg Config) time.Duration {
+	if cfg.Poll.LeaseDuration > 0 {
+		return cfg.Poll.LeaseDuration
+	}
+	return defaultClaimLease
+}
+
+func claimBatchSize(cfg Config) int {
+	if cfg.Poll.BatchSize > 0 {
+		return cfg.Poll.BatchSize
+	}
+	return defaultClaimBatchSize
+}
+
+// loadOrderLines fetches the lines of all given orders in a single query and
+// attaches them in line number order.
+func loadOrderLines(ctx context.Context, q dbQuerier, orders []PurchaseOrder) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(orders))
+	byID := make(map[string]*PurchaseOrder, len(orders))
+	for i := range orders {
+		ids[i] = orders[i].ID
+		byID[orders[i].ID] = &orders[i]
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT purchase_order_id, line_number, item_number, COALESCE(description, ''), quantity, unit, unit_price, line_amount, delivery_date, COALESCE(site, ''), COALESCE(warehouse, '')
+		FROM purchase_order_lines WHERE purchase_order_id = ANY($1) ORDER BY purchase_order_id, line_number`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var poID string
+		var line PurchaseOrderLine
+		var deliveryDate sql.NullTime
+		err := rows.Scan(&poID, &line.LineNumber, &line.ItemNumber, &line.Description, &line.Quantity, &line.Unit,
+			&line.UnitPrice, &line.LineAmount, &deliveryDate, &line.Site, &line.Warehouse)
+		if err != nil {
+			return err
+		}
+		if deliveryDate.Valid {
+			line.DeliveryDate = &deliveryDate.Time
+		}
+		if po, ok := byID[poID]; ok {
+			po.Lines = append(po.Lines, line)
+		}
+	}
+	return rows.Err()
+}
+
+// MarkOrdersQueued records that the orders' messages are in the outbox and
+// releases their claims, so a change made to an order right after it was
+// queued can be claimed straight away rather than when the lease expires.
+func MarkOrdersQueued(ctx context.Context, q dbQuerier, poIDs []string) error {
+	_, err := q.ExecContext(ctx, "UPDATE purchase_orders SET sync_status = $2, claimed_by = NULL, claimed_until = NULL WHERE id = ANY($1)",
+		pq.Array(poIDs), SyncStatusQueued)
+	return err
+}
+
+// MarkOrderSyncing records that a consumer has started posting the order to
+// Dynamics and returns the Dynamics key and ETags stored by an earlier sync, if
+// any. It returns errStaleEvent, leaving the order untouched, when version is older
+// than the order's current version because a newer change was made since the
+// event was published. A version of zero is never stale.
+func MarkOrderSyncing(ctx context.Context, poID string, version int64) (dynamicsRecord, error) {
+	var record dynamicsRecord
+	err := db.QueryRowContext(ctx, `UPDATE purchase_orders SET sync_status = CASE WHEN sync_status = 'pending' THEN sync_status ELSE $2 END
+		WHERE id = $1 AND ($3::BIGINT = 0 OR sync_version <= $3::BIGINT)
+		RETURNING COALESCE(dynamics_id, ''), COALESCE(dynamics_etag, '')`, poID, SyncStatusSyncing, version).Scan(&record.Key, &record.ETag)
+	if errors.Is(err, sql.ErrNoRows) {
+		if version > 0 {
+			return dynamicsRecord{}, errStaleEvent
+		}
+		return dynamicsRecord{}, nil
+	}
+	if err != nil || record.Key == "" {
+		return record, err
+	}
+	record.Lines, err = fetchDynamicsLines(ctx, poID)
+	return record, err
+}
+
+// fetchDynamicsLines returns the ETags of the order's lines as Dynamics last
+// returned them, by line number.
+func fetchDynamicsLines(ctx context.Context, poID string) (map[int]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT line_number, etag FROM dynamics_order_lines WHERE purchase_order_id = $1", poID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := map[int]string{}
+	for rows.Next() {
+		var lineNumber int
+		var etag string
+		if err := rows.Scan(&lineNumber, &etag); err != nil {
+			return nil, err
+		}
+		lines[lineNumber] = etag
+	}
+	return lines, rows.Err()
+}
+
+// saveDynamicsLines replaces the stored line ETags of the order with etags, a
+// JSON object of ETags by line number.
+func saveDynamicsLines(ctx context.Context, q dbQuerier, poID string, etags []byte) error {
+	if _, err := q.ExecContext(ctx, "DELETE FROM dynamics_order_lines WHERE purchase_order_id = $1", poID); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, `INSERT INTO dynamics_order_lines (purchase_order_id, line_number, etag)
+		SELECT $1, key::INTEGER, value FROM jsonb_each_text($2::JSONB)`, poID, string(etags))
+	return err
+}
+
+// updateSyncedOrder runs the update of the order's sync state and, when the
+// record carries line ETags, replaces the stored ones in the same transaction.
+func updateSyncedOrder(ctx context.Context, poID string, record dynamicsRecord, query string, args ...any) error {
+	if record.Lines == nil {
+		_, err := db.ExecContext(ctx, query, args...)
+		return err
+	}
+	etags, err := json.Marshal(record.Lines)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	if err := saveDynamicsLines(ctx, tx, poID, etags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkOrderSynced stores the Dynamics record key and ETags and flags the order
+// as synced. An empty header ETag leaves the stored one in place. An order that was
+// changed again while it was being synced stays pending, so the newer change
+// is still sent.
+func MarkOrderSynced(ctx context.Context, poID string, record dynamicsRecord) error {
+	return updateSyncedOrder(ctx, poID, record, `UPDATE purchase_orders SET sync_status = CASE WHEN sync_status = 'pending' THEN sync_status ELSE $2 END,
+		synced = TRUE, dynamics_id = $3, dynamics_etag = COALESCE(NULLIF($4, ''), dynamics_etag), synced_at = NOW(), sync_error = NULL WHERE id = $1`,
+		poID, SyncStatusSynced, record.Key, record.ETag)
+}
+
+// MarkOrderFailed flags the order as failed and keeps the reason for later
+// inspection, unless a newer change to the order is pending. The key and ETags
+// of a header and lines that were written before the failure are stored, so
+// the retry updates them instead of expecting the versions they replaced.
+func MarkOrderFailed(ctx context.Context, poID string, record dynamicsRecord, syncErr error) error {
+	return updateSyncedOrder(ctx, poID, record, `UPDATE purchase_orders SET sync_status = CASE WHEN sync_status = 'pending' THEN sync_status ELSE $2 END, sync_error = $3,
+		dynamics_id = COALESCE(NULLIF($4, ''), dynamics_id), dynamics_etag = COALESCE(NULLIF($5, ''), dynamics_etag) WHERE id = $1`,
+		poID, SyncStatusFailed, syncErr.Error(), record.Key, record.ETag)
+}
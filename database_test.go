@@ -1,13 +1,98 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
+func setupMockDB(t *testing.T) sqlmock.Sqlmock {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+
+	oldDB := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = oldDB
+		mockDB.Close()
+	})
+	return mock
+}
+
+// claimOrdersQuery matches the statement FetchPendingOrders claims orders with.
+const claimOrdersQuery = `UPDATE purchase_orders SET claimed_by = \$1, claimed_until = NOW\(\) \+ \$2 \* INTERVAL '1 second'\s+WHERE id IN \(\s+SELECT id FROM purchase_orders\s+WHERE sync_status = 'pending' AND \(status = 'APPROVED' OR sync_action = 'cancel'\) AND \(claimed_until IS NULL OR claimed_until < NOW\(\)\)\s+ORDER BY id LIMIT \$3\s+FOR UPDATE SKIP LOCKED`
+
+// pendingCountQuery matches the statement CountPendingOrders counts the backlog with.
+const pendingCountQuery = `SELECT COUNT\(\*\) FROM purchase_orders WHERE sync_status = 'pending' AND \(status = 'APPROVED' OR sync_action = 'cancel'\)`
+
+// markQueuedQuery is the statement MarkOrdersQueued marks orders queued and
+// releases their claims with.
+const markQueuedQuery = "UPDATE purchase_orders SET sync_status = $2, claimed_by = NULL, claimed_until = NULL WHERE id = ANY($1)"
+
+// orderColumns are the columns the claim statements return.
+var orderColumns = []string{"id", "vendor_id", "amount", "currency", "sync_action", "sync_version"}
+
+var orderLineColumns = []string{"purchase_order_id", "line_number", "item_number", "description", "quantity", "unit",
+	"unit_price", "line_amount", "delivery_date", "site", "warehouse"}
+
+// keepPendingStatus is the guard that leaves an order with a newer change
+// pending when its sync status is updated.
+const keepPendingStatus = "UPDATE purchase_orders SET sync_status = CASE WHEN sync_status = 'pending' THEN sync_status ELSE $2 END"
+
+// markSyncingQuery matches the statement MarkOrderSyncing claims the order with.
+var markSyncingQuery = regexp.QuoteMeta(keepPendingStatus) +
+	`\s+WHERE id = \$1 AND \(\$3::BIGINT = 0 OR sync_version <= \$3::BIGINT\)\s+RETURNING COALESCE\(dynamics_id, ''\), COALESCE\(dynamics_etag, ''\)`
+
+// expectMarkSyncing expects the order to be marked syncing and returns dynamicsID
+// as the key stored by an earlier sync, without an ETag.
+func expectMarkSyncing(mock sqlmock.Sqlmock, poID, dynamicsID string) {
+	expectMarkSyncingETag(mock, poID, dynamicsID, "")
+}
+
+// expectMarkSyncingETag is expectMarkSyncing with the stored ETag.
+func expectMarkSyncingETag(mock sqlmock.Sqlmock, poID, dynamicsID, etag string) {
+	expectMarkSyncingLines(mock, poID, dynamicsID, etag, nil)
+}
+
+// expectMarkSyncingLines is expectMarkSyncingETag with the stored line ETags,
+// which are only loaded for an order that has a Dynamics key.
+func expectMarkSyncingLines(mock sqlmock.Sqlmock, poID, dynamicsID, etag string, lines map[int]string) {
+	mock.ExpectQuery(markSyncingQuery).
+		WithArgs(poID, SyncStatusSyncing, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"dynamics_id", "dynamics_etag"}).AddRow(dynamicsID, etag))
+	if dynamicsID == "" {
+		return
+	}
+	rows := sqlmock.NewRows([]string{"line_number", "etag"})
+	for lineNumber, lineETag := range lines {
+		rows.AddRow(lineNumber, lineETag)
+	}
+	mock.ExpectQuery("SELECT line_number, etag FROM dynamics_order_lines WHERE purchase_order_id = \\$1").
+		WithArgs(poID).
+		WillReturnRows(rows)
+}
+
+// expectSaveLines expects the stored line ETags of the order to be replaced
+// with etags, a JSON object by line number.
+func expectSaveLines(mock sqlmock.Sqlmock, poID, etags string) {
+	mock.ExpectExec("DELETE FROM dynamics_order_lines WHERE purchase_order_id = \\$1").
+		WithArgs(poID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO dynamics_order_lines \\(purchase_order_id, line_number, etag\\)\\s+SELECT \\$1, key::INTEGER, value FROM jsonb_each_text").
+		WithArgs(poID, etags).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
 func TestFetchPendingOrders(t *testing.T) {
 	mockDB, mock, err := sqlmock.New()
 	if err != nil {
@@ -22,25 +107,43 @@ func TestFetchPendingOrders(t *testing.T) {
 	// Test case 1: Fetch pending orders successfully
 	t.Run("Fetch pending orders successfully", func(t *testing.T) {
 
-		rows := sqlmock.NewRows([]string{"id", "vendor_id", "amount", "currency"}).
-			AddRow("PO001", "V001", 100.50, "USD").
-			AddRow("PO002", "V002", 200.75, "EUR")
+		rows := sqlmock.NewRows(orderColumns).
+			AddRow("PO001", "V001", "100.50", "USD", SyncActionCreate, 1).
+			AddRow("PO002", "V002", "200.75", "EUR", SyncActionCreate, 1)
 
-		mock.ExpectQuery("SELECT id, vendor_id, amount, currency FROM purchase_orders WHERE status = 'APPROVED' AND synced = FALSE").
+		mock.ExpectQuery(claimOrdersQuery).
+			WithArgs(instanceID, defaultClaimLease.Seconds(), defaultClaimBatchSize).
 			WillReturnRows(rows)
 
-		orders, err := FetchPendingOrders()
+		deliveryDate := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+		lineRows := sqlmock.NewRows(orderLineColumns).
+			AddRow("PO001", 1, "ITEM-1", "Bolts", "10", "pcs", "5.00", "50.00", deliveryDate, "1", "11").
+			AddRow("PO001", 2, "ITEM-2", "", "1", "ea", "50.50", "50.50", nil, "", "")
+		mock.ExpectQuery("SELECT purchase_order_id, line_number").
+			WithArgs(pq.Array([]string{"PO001", "PO002"})).
+			WillReturnRows(lineRows)
+
+		orders, err := FetchPendingOrders(context.Background(), db, Config{})
 		assert.NoError(t, err)
 		assert.Len(t, orders, 2)
 
+		assert.Equal(t, []PurchaseOrderLine{
+			{LineNumber: 1, ItemNumber: "ITEM-1", Description: "Bolts", Quantity: decimal.NewFromInt(10), Unit: "pcs", UnitPrice: decimal.RequireFromString("5.00"), LineAmount: decimal.RequireFromString("50.00"), DeliveryDate: &deliveryDate, Site: "1", Warehouse: "11"},
+			{LineNumber: 2, ItemNumber: "ITEM-2", Quantity: decimal.NewFromInt(1), Unit: "ea", UnitPrice: decimal.RequireFromString("50.50"), LineAmount: decimal.RequireFromString("50.50")},
+		}, orders[0].Lines)
+		assert.Empty(t, orders[1].Lines)
+
+		assert.NotEmpty(t, orders[0].CorrelationID)
+		assert.NotEqual(t, orders[0].CorrelationID, orders[1].CorrelationID)
+
 		assert.Equal(t, "PO001", orders[0].ID)
 		assert.Equal(t, "V001", orders[0].VendorID)
-		assert.Equal(t, 100.50, orders[0].Amount)
+		assert.Equal(t, "100.50", orders[0].Amount.StringFixed(2))
 		assert.Equal(t, "USD", orders[0].Currency)
 
 		assert.Equal(t, "PO002", orders[1].ID)
 		assert.Equal(t, "V002", orders[1].VendorID)
-		assert.Equal(t, 200.75, orders[1].Amount)
+		assert.Equal(t, "200.75", orders[1].Amount.StringFixed(2))
 		assert.Equal(t, "EUR", orders[1].Currency)
 
 		assert.NoError(t, mock.ExpectationsWereMet())
@@ -48,12 +151,12 @@ func TestFetchPendingOrders(t *testing.T) {
 
 	// Test case 2: No pending orders
 	t.Run("No pending orders", func(t *testing.T) {
-		rows := sqlmock.NewRows([]string{"id", "vendor_id", "amount", "currency"})
+		rows := sqlmock.NewRows(orderColumns)
 
-		mock.ExpectQuery("SELECT id, vendor_id, amount, currency FROM purchase_orders WHERE status = 'APPROVED' AND synced = FALSE").
+		mock.ExpectQuery(claimOrdersQuery).
 			WillReturnRows(rows)
 
-		orders, err := FetchPendingOrders()
+		orders, err := FetchPendingOrders(context.Background(), db, Config{})
 		assert.NoError(t, err)
 		assert.Empty(t, orders)
 
@@ -62,15 +165,69 @@ func TestFetchPendingOrders(t *testing.T) {
 
 	// Test case 3: Database error
 	t.Run("Database error", func(t *testing.T) {
-		mock.ExpectQuery("SELECT id, vendor_id, amount, currency FROM purchase_orders WHERE status = 'APPROVED' AND synced = FALSE").
+		mock.ExpectQuery(claimOrdersQuery).
 			WillReturnError(sql.ErrConnDone)
 
-		orders, err := FetchPendingOrders()
+		orders, err := FetchPendingOrders(context.Background(), db, Config{})
 		assert.Error(t, err)
 		assert.Nil(t, orders)
 
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
+
+	// Test case 4: Configured batch size and lease
+	t.Run("Claim configured batch", func(t *testing.T) {
+		mock.ExpectQuery(claimOrdersQuery).
+			WithArgs(instanceID, 30.0, 5).
+			WillReturnRows(sqlmock.NewRows(orderColumns))
+
+		cfg := Config{Poll: PollConfig{BatchSize: 5, LeaseDuration: 30 * time.Second}}
+		orders, err := FetchPendingOrders(context.Background(), db, cfg)
+		assert.NoError(t, err)
+		assert.Empty(t, orders)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 5: Lines cannot be loaded
+	t.Run("Line query error", func(t *testing.T) {
+		rows := sqlmock.NewRows(orderColumns).
+			AddRow("PO001", "V001", "100.50", "USD", SyncActionCreate, 1)
+
+		mock.ExpectQuery(claimOrdersQuery).
+			WillReturnRows(rows)
+		mock.ExpectQuery("SELECT purchase_order_id, line_number").
+			WillReturnError(sql.ErrConnDone)
+
+		orders, err := FetchPendingOrders(context.Background(), db, Config{})
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		assert.Nil(t, orders)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCountPendingOrders(t *testing.T) {
+	// Test case 1: Pending orders are counted whether claimed or not
+	t.Run("Count pending orders", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery(pendingCountQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(12))
+
+		count, err := CountPendingOrders(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 12, count)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Database error
+	t.Run("Database error", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery(pendingCountQuery).WillReturnError(sql.ErrConnDone)
+
+		_, err := CountPendingOrders(context.Background())
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
 }
 
 func TestInitDB(t *testing.T) {
@@ -100,3 +257,63 @@ func TestInitDB(t *testing.T) {
 		assert.NotNil(t, db)
 	})
 }
+
+func TestMarkOrderSyncState(t *testing.T) {
+	// Test case 1: Mark orders as queued
+	t.Run("Mark orders queued", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectExec(regexp.QuoteMeta(markQueuedQuery)).
+			WithArgs(pq.Array([]string{"PO001", "PO002"}), SyncStatusQueued).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+
+		assert.NoError(t, MarkOrdersQueued(context.Background(), db, []string{"PO001", "PO002"}))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Mark order as syncing
+	t.Run("Mark order syncing", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMarkSyncingLines(mock, "PO001", "dataAreaId='usmf',PurchaseOrderNumber='PO001'", `W/"123"`, map[int]string{1: `W/"7"`})
+
+		record, err := MarkOrderSyncing(context.Background(), "PO001", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, dynamicsRecord{Key: "dataAreaId='usmf',PurchaseOrderNumber='PO001'", ETag: `W/"123"`, Lines: map[int]string{1: `W/"7"`}}, record)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 3: Mark order as synced with the Dynamics record key and ETag
+	t.Run("Mark order synced", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectExec(regexp.QuoteMeta(keepPendingStatus)+`,\s+synced = TRUE, dynamics_id = \$3, dynamics_etag = COALESCE\(NULLIF\(\$4, ''\), dynamics_etag\), synced_at = NOW\(\), sync_error = NULL WHERE id = \$1`).
+			WithArgs("PO001", SyncStatusSynced, "DYN-001", `W/"124"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		assert.NoError(t, MarkOrderSynced(context.Background(), "PO001", dynamicsRecord{Key: "DYN-001", ETag: `W/"124"`}))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 4: Mark order as failed with the error reason and the header written before it
+	t.Run("Mark order failed", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectExec(regexp.QuoteMeta(keepPendingStatus+", sync_error = $3,")+
+			`\s+`+regexp.QuoteMeta("dynamics_id = COALESCE(NULLIF($4, ''), dynamics_id), dynamics_etag = COALESCE(NULLIF($5, ''), dynamics_etag) WHERE id = $1")).
+			WithArgs("PO001", SyncStatusFailed, "post line 1: dynamics API Error: 500", "DYN-001", `W/"124"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := MarkOrderFailed(context.Background(), "PO001", dynamicsRecord{Key: "DYN-001", ETag: `W/"124"`}, errors.New("post line 1: dynamics API Error: 500"))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 5: Database error
+	t.Run("Database error", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery(markSyncingQuery).
+			WithArgs("PO001", SyncStatusSyncing, int64(0)).
+			WillReturnError(sql.ErrConnDone)
+
+		_, err := MarkOrderSyncing(context.Background(), "PO001", 0)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
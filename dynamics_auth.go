@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshSkew is how long before expiry a cached token is replaced, so a
+// request never goes out with a token that expires on the wire.
+const tokenRefreshSkew = 5 * time.Minute
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+var dynamicsTokenSource *TokenSource
+
+// TokenSource obtains bearer tokens for Dynamics 365 using the OAuth2 client
+// credentials grant, authenticating either with a client secret or with a
+// certificate-signed client assertion.
+type TokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+	certificate  *x509.Certificate
+	privateKey   *rsa.PrivateKey
+	httpClient   *http.Client
+	now          func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	TokenType        string      `json:"token_type"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func InitDynamics(cfg Config) {
+	dynamicsThrottle = NewDynamicsThrottle(cfg.Dynamics365)
+	dynamicsBreaker = NewCircuitBreaker(cfg.Dynamics365.BreakerThreshold, cfg.Dynamics365.BreakerCooldown)
+	dynamicsBreaker.onOpen = func(err error) {
+		ReportIncidentToGlitchTip(cfg, fmt.Sprintf("Dynamics circuit breaker opened: %v", err), map[string]string{
+			"component": "dynamics_circuit_breaker",
+		}, err)
+	}
+
+	if cfg.Dynamics365.ClientID == "" {
+		slog.Warn("Dynamics 365 client ID not configured, requests will be sent without authorization")
+		return
+	}
+
+	var err error
+	dynamicsTokenSource, err = NewTokenSource(cfg.Dynamics365)
+	if err != nil {
+		fatal("Failed to configure Dynamics 365 authentication", err)
+	}
+}
+
+func NewTokenSource(cfg Dynamics365Config) (*TokenSource, error) {
+	ts := &TokenSource{
+		tokenURL:     cfg.TokenURL,
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		scope:        cfg.Scope,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		now:          time.Now,
+	}
+
+	if ts.tokenURL == "" {
+		if cfg.TenantID == "" {
+			return nil, errors.New("dynamics365: tenant ID or token URL is required")
+		}
+		ts.tokenURL = fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", cfg.TenantID)
+	}
+
+	if ts.scope == "" {
+		apiURL, err := url.Parse(cfg.APIURL)
+		if err != nil || apiURL.Host == "" {
+			return nil, fmt.Errorf("dynamics365: cannot derive scope from API URL %q", cfg.APIURL)
+		}
+		ts.scope = fmt.Sprintf("%s://%s/.default", apiURL.Scheme, apiURL.Host)
+	}
+
+	if cfg.CertificatePath != "" {
+		cert, key, err := loadClientCertificate(cfg.CertificatePath)
+		if err != nil {
+			return nil, err
+		}
+		ts.certificate = cert
+		ts.privateKey = key
+	} else if ts.clientSecret == "" {
+		return nil, errors.New("dynamics365: client secret or certificate is required")
+	}
+
+	return ts, nil
+}
+
+// Token returns a cached bearer token, fetching a new one when none is cached
+// or the cached one is about to expire.
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && ts.now().Before(ts.refreshAt) {
+		return ts.token, nil
+	}
+
+	token, lifetime, err := ts.fetchToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	skew := tokenRefreshSkew
+	if skew > lifetime/2 {
+		skew = lifetime / 2
+	}
+	ts.token = token
+	ts.refreshAt = ts.now().Add(lifetime - skew)
+	return ts.token, nil
+}
+
+// Invalidate drops the cached token so the next call to Token fetches a new one.
+func (ts *TokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = ""
+}
+
+func (ts *TokenSource) fetchToken(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {ts.clientID},
+		"scope":      {ts.scope},
+	}
+
+	if ts.privateKey != nil {
+		assertion, err := ts.clientAssertion()
+		if err != nil {
+			return "", 0, err
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+	} else {
+		form.Set("client_secret", ts.clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	var body tokenResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+
+	if resp.StatusCode != http.StatusOK {
+		if body.Error != "" {
+			return "", 0, fmt.Errorf("token endpoint error: %s: %s", body.Error, body.ErrorDescription)
+		}
+		return "", 0, fmt.Errorf("token endpoint error: %s", resp.Status)
+	}
+	if decodeErr != nil {
+		return "", 0, fmt.Errorf("token endpoint returned invalid JSON: %w", decodeErr)
+	}
+	if body.AccessToken == "" {
+		return "", 0, errors.New("token endpoint returned no access token")
+	}
+
+	expiresIn, err := body.ExpiresIn.Int64()
+	if err != nil || expiresIn <= 0 {
+		return "", 0, fmt.Errorf("token endpoint returned invalid expires_in %q", body.ExpiresIn)
+	}
+
+	return body.AccessToken, time.Duration(expiresIn) * time.Second, nil
+}
+
+// clientAssertion builds the RS256-signed JWT Azure AD accepts in place of a
+// client secret for certificate credentials.
+func (ts *TokenSource) clientAssertion() (string, error) {
+	thumbprint := sha1.Sum(ts.certificate.Raw)
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := ts.now()
+	claims := map[string]interface{}{
+		"aud": ts.tokenURL,
+		"iss": ts.clientID,
+		"sub": ts.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"iat": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	}
+
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, ts.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// loadClientCertificate reads a PEM file holding both the certificate
+// registered with the Azure AD application and its RSA private key.
+func loadClientCertificate(path string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE" && cert == nil:
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+		case block.Type == "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			rsaKey, ok := parsed.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, errors.New("dynamics365: certificate private key must be RSA")
+			}
+			key = rsaKey
+		}
+	}
+
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("dynamics365: %s must contain a certificate and a private key", path)
+	}
+	return cert, key, nil
+}
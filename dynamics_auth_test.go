@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTokenServer(t *testing.T, expiresIn int, handle func(r *http.Request)) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		assert.NoError(t, r.ParseForm())
+		if handle != nil {
+			handle(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token_type":"Bearer","expires_in":%d,"access_token":"token-%d"}`, expiresIn, n)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestNewTokenSource(t *testing.T) {
+	// Test case 1: Token URL and scope derived from tenant and API URL
+	t.Run("Derive defaults", func(t *testing.T) {
+		ts, err := NewTokenSource(Dynamics365Config{
+			APIURL:       "https://contoso.operations.dynamics.com/data/PurchPurchaseOrderHeadersV2",
+			TenantID:     "tenant-1",
+			ClientID:     "client-1",
+			ClientSecret: "secret",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://login.microsoftonline.com/tenant-1/oauth2/v2.0/token", ts.tokenURL)
+		assert.Equal(t, "https://contoso.operations.dynamics.com/.default", ts.scope)
+	})
+
+	// Test case 2: Missing tenant and token URL
+	t.Run("Missing tenant", func(t *testing.T) {
+		_, err := NewTokenSource(Dynamics365Config{
+			APIURL:       "https://contoso.operations.dynamics.com",
+			ClientID:     "client-1",
+			ClientSecret: "secret",
+		})
+		assert.Error(t, err)
+	})
+
+	// Test case 3: Missing credentials
+	t.Run("Missing secret and certificate", func(t *testing.T) {
+		_, err := NewTokenSource(Dynamics365Config{
+			APIURL:   "https://contoso.operations.dynamics.com",
+			TenantID: "tenant-1",
+			ClientID: "client-1",
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestTokenSource(t *testing.T) {
+	// Test case 1: Client secret grant is cached
+	t.Run("Fetch and cache token with client secret", func(t *testing.T) {
+		server, calls := newTokenServer(t, 3600, func(r *http.Request) {
+			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+			assert.Equal(t, "client-1", r.PostForm.Get("client_id"))
+			assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+			assert.Equal(t, "https://api.example.com/.default", r.PostForm.Get("scope"))
+		})
+
+		ts, err := NewTokenSource(Dynamics365Config{
+			ClientID:     "client-1",
+			ClientSecret: "secret",
+			Scope:        "https://api.example.com/.default",
+			TokenURL:     server.URL,
+		})
+		assert.NoError(t, err)
+
+		token, err := ts.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+
+		token, err = ts.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+		assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	})
+
+	// Test case 2: Token is refreshed before it expires
+	t.Run("Proactively refresh token", func(t *testing.T) {
+		server, calls := newTokenServer(t, 3600, nil)
+
+		ts, err := NewTokenSource(Dynamics365Config{
+			ClientID:     "client-1",
+			ClientSecret: "secret",
+			Scope:        "https://api.example.com/.default",
+			TokenURL:     server.URL,
+		})
+		assert.NoError(t, err)
+
+		now := time.Now()
+		ts.now = func() time.Time { return now }
+
+		token, _ := ts.Token(context.Background())
+		assert.Equal(t, "token-1", token)
+
+		now = now.Add(time.Hour - tokenRefreshSkew - time.Second)
+		token, _ = ts.Token(context.Background())
+		assert.Equal(t, "token-1", token)
+
+		now = now.Add(2 * time.Second)
+		token, _ = ts.Token(context.Background())
+		assert.Equal(t, "token-2", token)
+		assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	})
+
+	// Test case 3: Invalidate forces a new token
+	t.Run("Invalidate token", func(t *testing.T) {
+		server, calls := newTokenServer(t, 3600, nil)
+
+		ts, err := NewTokenSource(Dynamics365Config{
+			ClientID:     "client-1",
+			ClientSecret: "secret",
+			Scope:        "https://api.example.com/.default",
+			TokenURL:     server.URL,
+		})
+		assert.NoError(t, err)
+
+		ts.Token(context.Background())
+		ts.Invalidate()
+		token, err := ts.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "token-2", token)
+		assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	})
+
+	// Test case 4: Token endpoint rejects the credentials
+	t.Run("Token endpoint error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS7000215: Invalid client secret provided."}`))
+		}))
+		defer server.Close()
+
+		ts, err := NewTokenSource(Dynamics365Config{
+			ClientID:     "client-1",
+			ClientSecret: "wrong",
+			Scope:        "https://api.example.com/.default",
+			TokenURL:     server.URL,
+		})
+		assert.NoError(t, err)
+
+		_, err = ts.Token(context.Background())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid_client")
+	})
+
+	// Test case 5: Certificate credentials send a signed client assertion
+	t.Run("Certificate client assertion", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "dynaproc"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.NoError(t, err)
+
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+		certPath := filepath.Join(t.TempDir(), "dynamics.pem")
+		assert.NoError(t, os.WriteFile(certPath, pemData, 0600))
+
+		var tokenURL string
+		server, _ := newTokenServer(t, 3600, func(r *http.Request) {
+			assert.Empty(t, r.PostForm.Get("client_secret"))
+			assert.Equal(t, clientAssertionType, r.PostForm.Get("client_assertion_type"))
+
+			parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+			if !assert.Len(t, parts, 3) {
+				return
+			}
+
+			var header map[string]string
+			headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+			assert.NoError(t, json.Unmarshal(headerJSON, &header))
+			thumbprint := sha1.Sum(certDER)
+			assert.Equal(t, "RS256", header["alg"])
+			assert.Equal(t, base64.RawURLEncoding.EncodeToString(thumbprint[:]), header["x5t"])
+
+			var claims map[string]interface{}
+			claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			assert.NoError(t, json.Unmarshal(claimsJSON, &claims))
+			assert.Equal(t, "client-1", claims["iss"])
+			assert.Equal(t, "client-1", claims["sub"])
+			assert.Equal(t, tokenURL, claims["aud"])
+
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+		})
+		tokenURL = server.URL
+
+		ts, err := NewTokenSource(Dynamics365Config{
+			ClientID:        "client-1",
+			CertificatePath: certPath,
+			Scope:           "https://api.example.com/.default",
+			TokenURL:        server.URL,
+		})
+		assert.NoError(t, err)
+
+		token, err := ts.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+	})
+}
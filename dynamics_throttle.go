@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultDynamicsRequestsPerSecond = 10
+	defaultDynamicsMaxConcurrent     = 4
+	defaultMaxThrottleRetries        = 3
+	defaultMaxRetryAfter             = 5 * time.Minute
+
+	// defaultThrottleDelay is used when a throttled response carries no
+	// usable Retry-After header.
+	defaultThrottleDelay = 5 * time.Second
+)
+
+var dynamicsThrottle *DynamicsThrottle
+
+// DynamicsThrottle keeps requests to Dynamics within the service protection
+// limits: a token bucket caps the request rate, a semaphore caps concurrent
+// requests, and a 429 or 503 with Retry-After pauses every request until the
+// tenant accepts traffic again.
+type DynamicsThrottle struct {
+	limiter       *rate.Limiter
+	slots         chan struct{}
+	maxRetries    int
+	maxRetryAfter time.Duration
+	now           func() time.Time
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func NewDynamicsThrottle(cfg Dynamics365Config) *DynamicsThrottle {
+	rps := cfg.RequestsPerSecond
+	if rps <= 0 {
+		rps = defaultDynamicsRequestsPerSecond
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = int(rps)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	concurrent := cfg.MaxConcurrentRequests
+	if concurrent <= 0 {
+		concurrent = defaultDynamicsMaxConcurrent
+	}
+	maxRetries := cfg.MaxThrottleRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	} else if maxRetries == 0 {
+		maxRetries = defaultMaxThrottleRetries
+	}
+	maxRetryAfter := cfg.MaxRetryAfter
+	if maxRetryAfter <= 0 {
+		maxRetryAfter = defaultMaxRetryAfter
+	}
+
+	return &DynamicsThrottle{
+		limiter:       rate.NewLimiter(rate.Limit(rps), burst),
+		slots:         make(chan struct{}, concurrent),
+		maxRetries:    maxRetries,
+		maxRetryAfter: maxRetryAfter,
+		now:           time.Now,
+	}
+}
+
+// acquire blocks until a request may be sent: any Retry-After pause has
+// passed, a rate token is available and a concurrency slot is free. The
+// returned function frees the slot.
+func (t *DynamicsThrottle) acquire(ctx context.Context) (func(), error) {
+	if err := sleepContext(ctx, t.pauseRemaining()); err != nil {
+		return nil, err
+	}
+	if err := t.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-t.slots }) }, nil
+}
+
+// pause holds back every request for d, extending but never shortening an
+// existing pause.
+func (t *DynamicsThrottle) pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := t.now().Add(d); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+func (t *DynamicsThrottle) pauseRemaining() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pausedUntil.Sub(t.now())
+}
+
+// retryDelay returns how long to wait before retrying a throttled response,
+// from its Retry-After header in seconds or as an HTTP date, capped at the
+// configured maximum.
+func (t *DynamicsThrottle) retryDelay(resp *http.Response) time.Duration {
+	delay := parseRetryAfter(resp.Header.Get("Retry-After"), t.now())
+	if delay <= 0 {
+		delay = defaultThrottleDelay
+	}
+	if delay > t.maxRetryAfter {
+		delay = t.maxRetryAfter
+	}
+	return delay
+}
+
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+func isThrottled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// throttledBody frees the concurrency slot once the caller is done with the
+// response body.
+type throttledBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b throttledBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// sendThrottled sends a request once the throttle admits it, retrying
+// throttled responses after their Retry-After delay. The last throttled
+// response is returned when the retries are used up.
+func sendThrottled(ctx context.Context, send func() (*http.Response, error)) (*http.Response, error) {
+	t := dynamicsThrottle
+	if t == nil {
+		return send()
+	}
+
+	for attempt := 0; ; attempt++ {
+		release, err := t.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := send()
+		if err != nil {
+			release()
+			return nil, err
+		}
+		resp.Body = throttledBody{ReadCloser: resp.Body, release: release}
+		if !isThrottled(resp) {
+			return resp, nil
+		}
+
+		delay := t.retryDelay(resp)
+		t.pause(delay)
+		dynamicsThrottled.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		dynamicsThrottleWait.Add(delay.Seconds())
+		if attempt >= t.maxRetries {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		slog.Warn("Dynamics throttled the request, backing off", "status", resp.StatusCode, "retry_after", delay, "attempt", attempt+1)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
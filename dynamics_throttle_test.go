@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// useDynamicsThrottle installs a throttle built from cfg for the duration of the test.
+func useDynamicsThrottle(t *testing.T, cfg Dynamics365Config) *DynamicsThrottle {
+	original := dynamicsThrottle
+	dynamicsThrottle = NewDynamicsThrottle(cfg)
+	t.Cleanup(func() { dynamicsThrottle = original })
+	return dynamicsThrottle
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Wed, 01 May 2024 10:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestDynamicsThrottleRetryDelay(t *testing.T) {
+	throttle := NewDynamicsThrottle(Dynamics365Config{MaxRetryAfter: time.Minute})
+
+	resp := &http.Response{Header: http.Header{}}
+	assert.Equal(t, defaultThrottleDelay, throttle.retryDelay(resp))
+
+	resp.Header.Set("Retry-After", "12")
+	assert.Equal(t, 12*time.Second, throttle.retryDelay(resp))
+
+	resp.Header.Set("Retry-After", "3600")
+	assert.Equal(t, time.Minute, throttle.retryDelay(resp))
+}
+
+func TestDoDynamicsRequestThrottling(t *testing.T) {
+	// Test case 1: A 429 is retried after Retry-After
+	t.Run("Retry after 429", func(t *testing.T) {
+		useDynamicsThrottle(t, Dynamics365Config{MaxRetryAfter: 20 * time.Millisecond})
+		throttledBefore := testutil.ToFloat64(dynamicsThrottled.WithLabelValues("429"))
+
+		var calls int32
+		var retriedAfter time.Duration
+		var firstCall time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				firstCall = time.Now()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			retriedAfter = time.Since(firstCall)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		resp, err := doDynamicsRequest(context.Background(), "POST", server.URL, nil, []byte(`{}`))
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		assert.GreaterOrEqual(t, retriedAfter, 20*time.Millisecond, "retry must wait for the capped Retry-After")
+		assert.Equal(t, throttledBefore+1, testutil.ToFloat64(dynamicsThrottled.WithLabelValues("429")))
+	})
+
+	// Test case 2: The throttled response is returned once retries are used up
+	t.Run("Retries exhausted", func(t *testing.T) {
+		useDynamicsThrottle(t, Dynamics365Config{MaxRetryAfter: time.Millisecond, MaxThrottleRetries: 2})
+
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		resp, err := doDynamicsRequest(context.Background(), "POST", server.URL, nil, []byte(`{}`))
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	})
+
+	// Test case 3: Retrying can be disabled
+	t.Run("Retries disabled", func(t *testing.T) {
+		useDynamicsThrottle(t, Dynamics365Config{MaxThrottleRetries: -1})
+
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+
+		resp, err := doDynamicsRequest(context.Background(), "POST", server.URL, nil, []byte(`{}`))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	// Test case 4: A pause is honoured by other requests and by cancellation
+	t.Run("Cancelled while paused", func(t *testing.T) {
+		throttle := useDynamicsThrottle(t, Dynamics365Config{})
+		throttle.pause(time.Hour)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := doDynamicsRequest(ctx, "POST", "http://127.0.0.1:1", nil, []byte(`{}`))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	// Test case 5: Concurrent requests are capped
+	t.Run("Concurrency limit", func(t *testing.T) {
+		useDynamicsThrottle(t, Dynamics365Config{RequestsPerSecond: 1000, MaxConcurrentRequests: 2})
+
+		var inFlight, maxInFlight int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		done := make(chan struct{})
+		for i := 0; i < 6; i++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				resp, err := doDynamicsRequest(context.Background(), "POST", server.URL, nil, []byte(`{}`))
+				if assert.NoError(t, err) {
+					resp.Body.Close()
+				}
+			}()
+		}
+		for i := 0; i < 6; i++ {
+			<-done
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+	})
+
+	// Test case 6: Requests are rate limited
+	t.Run("Rate limit", func(t *testing.T) {
+		useDynamicsThrottle(t, Dynamics365Config{RequestsPerSecond: 50, Burst: 1})
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			resp, err := doDynamicsRequest(context.Background(), "POST", server.URL, nil, []byte(`{}`))
+			assert.NoError(t, err)
+			resp.Body.Close()
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 55*time.Millisecond)
+	})
+}
@@ -3,16 +3,264 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
 )
 
-func ReportErrorToGlitchTip(cfg Config, poID string, err error) {
-	payload := map[string]string{
-		"title":   "Purchase Order Sync Failed",
-		"message": fmt.Sprintf("Failed to sync PO: %s, Error: %v", poID, err),
+const (
+	sentryProtocolVersion = "7"
+	sentryClient          = "dynaproc-glitchtip/1.0"
+	maxExceptionChain     = 10
+)
+
+var glitchTipClient = &http.Client{Timeout: 10 * time.Second}
+
+// glitchTipDSN holds the parts of a Sentry-style DSN,
+// https://<public key>@<host>[/<path>]/<project id>.
+type glitchTipDSN struct {
+	PublicKey string
+	ProjectID string
+	StoreURL  string
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     sentryMessage     `json:"message"`
+	Tags        map[string]string `json:"tags"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+}
+
+type sentryMessage struct {
+	Formatted string `json:"formatted"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// ReportErrorToGlitchTip submits a sync failure to GlitchTip's Sentry-compatible
+// store endpoint. When no DSN is configured or the submission fails, the event
+// is written to the log instead so it is not lost.
+func ReportErrorToGlitchTip(cfg Config, po PurchaseOrder, err error) {
+	event := newSentryEvent(cfg, fmt.Sprintf("Failed to sync PO: %s, Error: %v", po.ID, err), map[string]string{
+		"po_id":          po.ID,
+		"vendor_id":      po.VendorID,
+		"correlation_id": po.CorrelationID,
+	}, err)
+	submitToGlitchTip(cfg, event)
+}
+
+// ReportIncidentToGlitchTip submits a failure that is not tied to a single
+// purchase order, such as the Dynamics circuit breaker opening.
+func ReportIncidentToGlitchTip(cfg Config, message string, tags map[string]string, err error) {
+	event := newSentryEvent(cfg, message, tags, err)
+	submitToGlitchTip(cfg, event)
+}
+
+func submitToGlitchTip(cfg Config, event sentryEvent) {
+	if cfg.GlitchTip.DSN == "" {
+		logUnreportedEvent(event, errors.New("no GlitchTip DSN configured"))
+		return
+	}
+
+	dsn, dsnErr := parseGlitchTipDSN(cfg.GlitchTip.DSN)
+	if dsnErr != nil {
+		logUnreportedEvent(event, dsnErr)
+		return
+	}
+
+	if submitErr := submitSentryEvent(dsn, event); submitErr != nil {
+		logUnreportedEvent(event, submitErr)
+	}
+}
+
+func parseGlitchTipDSN(raw string) (*glitchTipDSN, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GlitchTip DSN: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid GlitchTip DSN: unsupported scheme %q", u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("invalid GlitchTip DSN: missing public key")
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	projectID := path[slash+1:]
+	if projectID == "" {
+		return nil, errors.New("invalid GlitchTip DSN: missing project ID")
 	}
-	jsonPayload, _ := json.Marshal(payload)
 
-	http.Post(cfg.GlitchTip.APIURL, "application/json", bytes.NewBuffer(jsonPayload))
+	return &glitchTipDSN{
+		PublicKey: u.User.Username(),
+		ProjectID: projectID,
+		StoreURL:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:slash], projectID),
+	}, nil
+}
+
+func newSentryEvent(cfg Config, message string, tags map[string]string, err error) sentryEvent {
+	hostname, _ := os.Hostname()
+
+	event := sentryEvent{
+		EventID:     newRandomID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      cfg.AppName,
+		ServerName:  hostname,
+		Release:     cfg.AppVersion,
+		Environment: cfg.Environment,
+		Message:     sentryMessage{Formatted: message},
+		Tags:        tags,
+	}
+
+	if err != nil {
+		event.Exception = &sentryExceptions{Values: exceptionChain(err)}
+	}
+	return event
+}
+
+// exceptionChain lists the wrapped errors innermost first, as Sentry expects,
+// with the stack trace of the reporting goroutine on the outermost error.
+func exceptionChain(err error) []sentryException {
+	var chain []sentryException
+	for e := err; e != nil && len(chain) < maxExceptionChain; e = errors.Unwrap(e) {
+		chain = append([]sentryException{{
+			Type:  reflect.TypeOf(e).String(),
+			Value: e.Error(),
+		}}, chain...)
+	}
+	chain[len(chain)-1].Stacktrace = currentStacktrace()
+	return chain
+}
+
+// appModulePath is this binary's module path, under which package main is
+// reported in test builds.
+var appModulePath = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Path
+	}
+	return ""
+}()
+
+func currentStacktrace() *sentryStacktrace {
+	pcs := make([]uintptr, 50)
+	// skip runtime.Callers and the reporting functions up to ReportErrorToGlitchTip
+	n := runtime.Callers(5, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var stack []sentryFrame
+	for {
+		frame, more := frames.Next()
+		module, function := splitFunctionName(frame.Function)
+		stack = append([]sentryFrame{{
+			Function: function,
+			Module:   module,
+			Filename: filepath.Base(frame.File),
+			AbsPath:  frame.File,
+			Lineno:   frame.Line,
+			InApp:    module == "main" || module == appModulePath,
+		}}, stack...)
+		if !more {
+			break
+		}
+	}
+	return &sentryStacktrace{Frames: stack}
+}
+
+// splitFunctionName splits "net/http.(*Client).Do" into "net/http" and "(*Client).Do".
+func splitFunctionName(name string) (string, string) {
+	lastSlash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[lastSlash+1:], ".")
+	if dot == -1 {
+		return "", name
+	}
+	dot += lastSlash + 1
+	return name[:dot], name[dot+1:]
+}
+
+func submitSentryEvent(dsn *glitchTipDSN, event sentryEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", dsn.StoreURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=%s, sentry_client=%s, sentry_timestamp=%d, sentry_key=%s",
+		sentryProtocolVersion, sentryClient, time.Now().Unix(), dsn.PublicKey))
+
+	resp, err := glitchTipClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GlitchTip rejected event: %s", resp.Status)
+	}
+	return nil
+}
+
+func logUnreportedEvent(event sentryEvent, reason error) {
+	args := []any{
+		"event_id", event.EventID,
+		"message", event.Message.Formatted,
+	}
+	tagNames := make([]string, 0, len(event.Tags))
+	for name := range event.Tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+	for _, name := range tagNames {
+		args = append(args, name, event.Tags[name])
+	}
+	args = append(args, "reason", reason)
+	if event.Exception != nil {
+		outer := event.Exception.Values[len(event.Exception.Values)-1]
+		args = append(args, "exception_type", outer.Type)
+	}
+	slog.Error("Error not reported to GlitchTip", args...)
 }
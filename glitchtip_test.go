@@ -3,158 +3,204 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func glitchTipDSNFor(server *httptest.Server) string {
+	return strings.Replace(server.URL, "http://", "http://public-key@", 1) + "/42"
+}
+
+func TestParseGlitchTipDSN(t *testing.T) {
+	// Test case 1: Plain DSN
+	t.Run("Valid DSN", func(t *testing.T) {
+		dsn, err := parseGlitchTipDSN("https://abc123@glitchtip.example.com/7")
+		assert.NoError(t, err)
+		assert.Equal(t, "abc123", dsn.PublicKey)
+		assert.Equal(t, "7", dsn.ProjectID)
+		assert.Equal(t, "https://glitchtip.example.com/api/7/store/", dsn.StoreURL)
+	})
+
+	// Test case 2: DSN with a path prefix and port
+	t.Run("DSN with path prefix", func(t *testing.T) {
+		dsn, err := parseGlitchTipDSN("http://abc123@localhost:8000/errors/7")
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8000/errors/api/7/store/", dsn.StoreURL)
+	})
+
+	// Test case 3: Invalid DSNs
+	t.Run("Invalid DSN", func(t *testing.T) {
+		for _, raw := range []string{
+			"not-a-valid-url",
+			"https://glitchtip.example.com/7",
+			"https://abc123@glitchtip.example.com/",
+			"ftp://abc123@glitchtip.example.com/7",
+		} {
+			_, err := parseGlitchTipDSN(raw)
+			assert.Error(t, err, raw)
+		}
+	})
+}
+
 func TestReportErrorToGlitchTip(t *testing.T) {
+	cfgFor := func(server *httptest.Server) Config {
+		return Config{
+			AppName:     "dynaproc",
+			AppVersion:  "1.2.3",
+			Environment: "test",
+			GlitchTip:   GlitchTipConfig{DSN: glitchTipDSNFor(server)},
+		}
+	}
+
+	po := PurchaseOrder{ID: "PO123", VendorID: "V001", CorrelationID: "corr-1"}
+
 	// Test case 1: Successful error report with full validation
 	t.Run("Successfully report error with full validation", func(t *testing.T) {
-		var receivedPayload map[string]string
+		var event map[string]interface{}
 		requestReceived := false
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			requestReceived = true
 
 			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, "/api/42/store/", r.URL.Path)
 			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_version=7")
+			assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_key=public-key")
 
 			body, err := io.ReadAll(r.Body)
 			assert.NoError(t, err)
-			err = json.Unmarshal(body, &receivedPayload)
-			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal(body, &event))
 
 			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(`{"status":"ok"}`))
+			w.Write([]byte(`{"id":"ok"}`))
 		}))
 		defer server.Close()
 
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: server.URL,
-			},
-		}
-
-		testError := errors.New("test sync error")
-		testPOID := "PO123"
-
-		ReportErrorToGlitchTip(cfg, testPOID, testError)
+		syncErr := fmt.Errorf("sync PO123: %w", &DynamicsAPIError{StatusCode: 500, Status: "500 Internal Server Error"})
+		ReportErrorToGlitchTip(cfgFor(server), po, syncErr)
 
 		assert.True(t, requestReceived, "Request was not received by the server")
-
-		expectedTitle := "Purchase Order Sync Failed"
-		expectedMessage := "Failed to sync PO: PO123, Error: test sync error"
-
-		assert.Equal(t, expectedTitle, receivedPayload["title"])
-		assert.Equal(t, expectedMessage, receivedPayload["message"])
+		assert.Len(t, event["event_id"], 32)
+		assert.NotEmpty(t, event["timestamp"])
+		assert.Equal(t, "error", event["level"])
+		assert.Equal(t, "go", event["platform"])
+		assert.Equal(t, "1.2.3", event["release"])
+		assert.Equal(t, "test", event["environment"])
+		assert.Equal(t, "Failed to sync PO: PO123, Error: sync PO123: dynamics API Error: 500 Internal Server Error",
+			event["message"].(map[string]interface{})["formatted"])
+
+		tags := event["tags"].(map[string]interface{})
+		assert.Equal(t, "PO123", tags["po_id"])
+		assert.Equal(t, "V001", tags["vendor_id"])
+		assert.Equal(t, "corr-1", tags["correlation_id"])
+
+		values := event["exception"].(map[string]interface{})["values"].([]interface{})
+		assert.Len(t, values, 2)
+		inner := values[0].(map[string]interface{})
+		outer := values[1].(map[string]interface{})
+		assert.Equal(t, "*main.DynamicsAPIError", inner["type"])
+		assert.Equal(t, "*fmt.wrapError", outer["type"])
+
+		frames := outer["stacktrace"].(map[string]interface{})["frames"].([]interface{})
+		assert.NotEmpty(t, frames)
+		last := frames[len(frames)-1].(map[string]interface{})
+		assert.Equal(t, "TestReportErrorToGlitchTip.func2", last["function"])
+		assert.Equal(t, true, last["in_app"])
 	})
 
-	// Test case 2: Error report with empty PO ID
-	t.Run("Report error with empty PO ID", func(t *testing.T) {
-		var receivedPayload map[string]string
+	// Test case 2: Error report with nil error
+	t.Run("Report with nil error", func(t *testing.T) {
+		var event map[string]interface{}
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			body, _ := io.ReadAll(r.Body)
-			json.Unmarshal(body, &receivedPayload)
+			json.Unmarshal(body, &event)
 			w.WriteHeader(http.StatusOK)
 		}))
 		defer server.Close()
 
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: server.URL,
-			},
-		}
+		ReportErrorToGlitchTip(cfgFor(server), po, nil)
 
-		testError := errors.New("test error")
-		ReportErrorToGlitchTip(cfg, "", testError)
-
-		expectedMessage := "Failed to sync PO: , Error: test error"
-		assert.Equal(t, expectedMessage, receivedPayload["message"])
+		assert.Equal(t, "Failed to sync PO: PO123, Error: <nil>", event["message"].(map[string]interface{})["formatted"])
+		assert.Nil(t, event["exception"])
 	})
 
-	// Test case 3: Error report with nil error
-	t.Run("Report with nil error", func(t *testing.T) {
-		var receivedPayload map[string]string
+	// Test case 3: Server rejects the event
+	t.Run("Server returns error", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			body, _ := io.ReadAll(r.Body)
-			json.Unmarshal(body, &receivedPayload)
-			w.WriteHeader(http.StatusOK)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"invalid key"}`))
 		}))
 		defer server.Close()
 
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: server.URL,
-			},
-		}
-
-		ReportErrorToGlitchTip(cfg, "PO123", nil)
+		ReportErrorToGlitchTip(cfgFor(server), po, errors.New("test error"))
 
-		expectedMessage := "Failed to sync PO: PO123, Error: <nil>"
-		assert.Equal(t, expectedMessage, receivedPayload["message"])
+		lines := decodeLogLines(t, logs)
+		if assert.Len(t, lines, 1) {
+			assert.Equal(t, "Error not reported to GlitchTip", lines[0]["msg"])
+			assert.Equal(t, "PO123", lines[0]["po_id"])
+			assert.Contains(t, lines[0]["reason"], "403")
+			assert.Equal(t, "*errors.errorString", lines[0]["exception_type"])
+		}
 	})
 
-	// Test case 4: Server returns error
-	t.Run("Server returns error", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"error":"internal server error"}`))
-		}))
-		defer server.Close()
+	// Test case 4: GlitchTip unreachable
+	t.Run("Network error", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
 
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: server.URL,
-			},
-		}
+		cfg := Config{GlitchTip: GlitchTipConfig{DSN: "http://key@127.0.0.1:1/1"}}
+		ReportErrorToGlitchTip(cfg, po, errors.New("test error"))
 
-		ReportErrorToGlitchTip(cfg, "PO123", errors.New("test error"))
+		assert.Contains(t, logs.String(), "Error not reported to GlitchTip")
 	})
 
-	// Test case 5: Network timeout
-	t.Run("Network timeout", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			time.Sleep(100 * time.Millisecond)
-			w.WriteHeader(http.StatusOK)
-		}))
-		defer server.Close()
+	// Test case 5: Invalid DSN
+	t.Run("Invalid DSN", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
 
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: server.URL,
-			},
-		}
+		cfg := Config{GlitchTip: GlitchTipConfig{DSN: "not-a-valid-url"}}
+		ReportErrorToGlitchTip(cfg, po, errors.New("test error"))
 
-		ReportErrorToGlitchTip(cfg, "PO123", errors.New("test error"))
+		assert.Contains(t, logs.String(), "invalid GlitchTip DSN")
 	})
 
-	// Test case 6: Invalid URL
-	t.Run("Invalid URL", func(t *testing.T) {
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: "not-a-valid-url",
-			},
-		}
+	// Test case 6: Empty DSN
+	t.Run("Empty DSN", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
 
-		ReportErrorToGlitchTip(cfg, "PO123", errors.New("test error"))
-	})
-
-	// Test case 7: Empty URL
-	t.Run("Empty URL", func(t *testing.T) {
-		cfg := Config{
-			GlitchTip: GlitchTipConfig{
-				APIURL: "",
-			},
-		}
+		ReportErrorToGlitchTip(Config{}, po, errors.New("test error"))
 
-		ReportErrorToGlitchTip(cfg, "PO123", errors.New("test error"))
+		assert.Contains(t, logs.String(), "no GlitchTip DSN configured")
 	})
 }
+
+func TestReportIncidentToGlitchTip(t *testing.T) {
+	var event map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := Config{GlitchTip: GlitchTipConfig{DSN: glitchTipDSNFor(server)}}
+	ReportIncidentToGlitchTip(cfg, "Dynamics circuit breaker opened", map[string]string{"component": "dynamics_circuit_breaker"},
+		&DynamicsAPIError{StatusCode: 503, Status: "503 Service Unavailable"})
+
+	assert.Equal(t, "Dynamics circuit breaker opened", event["message"].(map[string]interface{})["formatted"])
+	assert.Equal(t, map[string]interface{}{"component": "dynamics_circuit_breaker"}, event["tags"])
+
+	values := event["exception"].(map[string]interface{})["values"].([]interface{})
+	frames := values[0].(map[string]interface{})["stacktrace"].(map[string]interface{})["frames"].([]interface{})
+	assert.Equal(t, "TestReportIncidentToGlitchTip", frames[len(frames)-1].(map[string]interface{})["function"])
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+	shutdownTimeout    = 5 * time.Second
+
+	// httpDisabled as the HTTP address turns the server off.
+	httpDisabled = "off"
+
+	statusOK       = "ok"
+	statusDown     = "down"
+	statusDegraded = "degraded"
+	statusUnknown  = "unknown"
+	statusStandby  = "standby"
+)
+
+// healthState is updated by the pipeline and read by the health endpoints.
+// Timestamps are Unix nanoseconds, zero meaning "never".
+type healthState struct {
+	startedAt       time.Time
+	lastPoll        atomic.Int64
+	lastDynamicsOK  atomic.Int64
+	lastDynamicsErr atomic.Int64
+	consumerActive  atomic.Bool
+	electionEnabled atomic.Bool
+	leaderSince     atomic.Int64
+}
+
+var health = &healthState{startedAt: time.Now()}
+
+type healthCheck struct {
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+	AgeSeconds *float64   `json:"age_seconds,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func (h *healthState) RecordPoll() {
+	h.lastPoll.Store(time.Now().UnixNano())
+}
+
+func (h *healthState) RecordDynamicsSuccess() {
+	h.lastDynamicsOK.Store(time.Now().UnixNano())
+}
+
+func (h *healthState) RecordDynamicsFailure() {
+	h.lastDynamicsErr.Store(time.Now().UnixNano())
+}
+
+func (h *healthState) SetConsumerActive(active bool) {
+	h.consumerActive.Store(active)
+}
+
+// EnableLeaderElection marks the poller as leader-only, so a standby instance
+// that is not polling is still reported healthy.
+func (h *healthState) EnableLeaderElection() {
+	h.electionEnabled.Store(true)
+}
+
+func (h *healthState) SetLeader(leader bool) {
+	if leader {
+		h.leaderSince.Store(time.Now().UnixNano())
+	} else {
+		h.leaderSince.Store(0)
+	}
+}
+
+// StartHTTPServer serves the health and metrics endpoints on cfg.HTTP.Address until ctx is
+// cancelled. It does nothing when the address is empty or "off".
+func StartHTTPServer(ctx context.Context, cfg Config) {
+	if cfg.HTTP.Address == "" || cfg.HTTP.Address == httpDisabled {
+		return
+	}
+
+	server := &http.Server{
+		Addr:              cfg.HTTP.Address,
+		Handler:           newHTTPHandler(cfg),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		slog.Info("HTTP server listening", "address", cfg.HTTP.Address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shut down HTTP server", "error", err)
+		}
+	}()
+}
+
+func newHTTPHandler(cfg Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]healthCheck{
+			"poll_loop": checkPollLoop(cfg),
+		}
+		if health.electionEnabled.Load() {
+			checks["leader"] = checkLeader()
+		}
+		writeHealth(w, checks)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]healthCheck{
+			"postgres": checkPostgres(r.Context()),
+			"rabbitmq": checkRabbitMQ(),
+			"consumer": checkConsumer(),
+			"dynamics": checkDynamics(),
+		})
+	})
+	return mux
+}
+
+// writeHealth responds 503 if any check is down; degraded checks are reported
+// but do not fail the probe.
+func writeHealth(w http.ResponseWriter, checks map[string]healthCheck) {
+	resp := healthResponse{Status: statusOK, Checks: checks}
+	code := http.StatusOK
+	for _, check := range checks {
+		if check.Status == statusDown {
+			resp.Status = statusDown
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkPollLoop fails once the poll loop has not ticked for PollStaleAfter.
+// In notify mode the loop may idle for a whole sweep interval, so it is given
+// at least three of them. Until the first tick the process start time stands
+// in for it.
+func checkPollLoop(cfg Config) healthCheck {
+	if health.electionEnabled.Load() && health.leaderSince.Load() == 0 {
+		return healthCheck{Status: statusStandby}
+	}
+
+	staleAfter := cfg.HTTP.PollStaleAfter
+	if staleAfter <= 0 || (cfg.Poll.Mode == pollModeNotify && staleAfter < 3*fetchInterval(cfg)) {
+		staleAfter = 3 * fetchInterval(cfg)
+	}
+
+	last := health.startedAt
+	if nanos := health.lastPoll.Load(); nanos != 0 {
+		last = time.Unix(0, nanos)
+	}
+
+	check := timedCheck(statusOK, last)
+	if time.Since(last) > staleAfter {
+		check.Status = statusDown
+		check.Error = "poll loop has not run in " + time.Since(last).Round(time.Second).String()
+	}
+	return check
+}
+
+// checkLeader reports whether this instance currently runs the poller and
+// since when. Being standby is not a failure.
+func checkLeader() healthCheck {
+	nanos := health.leaderSince.Load()
+	if nanos == 0 {
+		return healthCheck{Status: statusStandby}
+	}
+	return timedCheck(statusOK, time.Unix(0, nanos))
+}
+
+func checkPostgres(ctx context.Context) healthCheck {
+	if db == nil {
+		return healthCheck{Status: statusDown, Error: "not initialized"}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return healthCheck{Status: statusDown, Error: err.Error()}
+	}
+	return healthCheck{Status: statusOK}
+}
+
+func checkRabbitMQ() healthCheck {
+	rabbitMu.RLock()
+	conn := rabbitConn
+	rabbitMu.RUnlock()
+
+	if conn == nil {
+		return healthCheck{Status: statusDown, Error: "not connected"}
+	}
+	if conn.IsClosed() {
+		return healthCheck{Status: statusDown, Error: "connection closed"}
+	}
+	return healthCheck{Status: statusOK}
+}
+
+func checkConsumer() healthCheck {
+	if !health.consumerActive.Load() {
+		return healthCheck{Status: statusDown, Error: "consumer not active"}
+	}
+	return healthCheck{Status: statusOK}
+}
+
+// checkDynamics reports how long ago Dynamics last accepted a request. It never
+// fails readiness: an unreachable Dynamics is handled by retries, and restarting
+// the service would not fix it.
+func checkDynamics() healthCheck {
+	okNanos := health.lastDynamicsOK.Load()
+	errNanos := health.lastDynamicsErr.Load()
+
+	if okNanos == 0 {
+		if errNanos != 0 {
+			return healthCheck{Status: statusDegraded, Error: "no successful call since start"}
+		}
+		return healthCheck{Status: statusUnknown}
+	}
+
+	check := timedCheck(statusOK, time.Unix(0, okNanos))
+	if errNanos > okNanos {
+		check.Status = statusDegraded
+		check.Error = "last call failed"
+	}
+	return check
+}
+
+func timedCheck(status string, last time.Time) healthCheck {
+	age := time.Since(last).Seconds()
+	return healthCheck{Status: status, LastSeen: &last, AgeSeconds: &age}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// useHealthState swaps in a fresh health state for the duration of the test.
+func useHealthState(t *testing.T) *healthState {
+	original := health
+	health = &healthState{startedAt: time.Now()}
+	t.Cleanup(func() { health = original })
+	return health
+}
+
+func getHealth(t *testing.T, handler http.Handler, path string) (int, healthResponse) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+	var resp healthResponse
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return rec.Code, resp
+}
+
+func TestHealthz(t *testing.T) {
+	// Test case 1: Poll loop ticked recently
+	t.Run("Poll loop ticking", func(t *testing.T) {
+		state := useHealthState(t)
+		state.RecordPoll()
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, statusOK, resp.Status)
+		assert.Equal(t, statusOK, resp.Checks["poll_loop"].Status)
+		assert.NotNil(t, resp.Checks["poll_loop"].LastSeen)
+	})
+
+	// Test case 2: Poll loop stalled
+	t.Run("Poll loop stalled", func(t *testing.T) {
+		state := useHealthState(t)
+		state.lastPoll.Store(time.Now().Add(-time.Minute).UnixNano())
+
+		cfg := Config{HTTP: HTTPConfig{PollStaleAfter: 10 * time.Second}}
+		code, resp := getHealth(t, newHTTPHandler(cfg), "/healthz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, statusDown, resp.Status)
+		assert.Contains(t, resp.Checks["poll_loop"].Error, "has not run")
+	})
+
+	// Test case 3: Notify mode waits for a sweep interval between fetches
+	t.Run("Poll loop idle between sweeps", func(t *testing.T) {
+		state := useHealthState(t)
+		state.lastPoll.Store(time.Now().Add(-time.Minute).UnixNano())
+
+		cfg := Config{
+			HTTP: HTTPConfig{PollStaleAfter: 10 * time.Second},
+			Poll: PollConfig{Mode: pollModeNotify, SweepInterval: time.Minute},
+		}
+		code, resp := getHealth(t, newHTTPHandler(cfg), "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, statusOK, resp.Checks["poll_loop"].Status)
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	setupRabbitConn := func(t *testing.T, closed bool) {
+		conn := new(MockAMQPConnection)
+		conn.On("IsClosed").Return(closed)
+		originalConn := rabbitConn
+		rabbitConn = conn
+		t.Cleanup(func() { rabbitConn = originalConn })
+	}
+
+	setupPingDB := func(t *testing.T, pingErr error) sqlmock.Sqlmock {
+		mockDB, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Fatalf("Failed to create mock database: %v", err)
+		}
+		oldDB := db
+		db = mockDB
+		t.Cleanup(func() {
+			db = oldDB
+			mockDB.Close()
+		})
+		mock.ExpectPing().WillReturnError(pingErr)
+		return mock
+	}
+
+	// Test case 1: All dependencies up
+	t.Run("Ready", func(t *testing.T) {
+		state := useHealthState(t)
+		state.SetConsumerActive(true)
+		state.RecordDynamicsSuccess()
+		setupRabbitConn(t, false)
+		mock := setupPingDB(t, nil)
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/readyz")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, statusOK, resp.Status)
+		assert.Equal(t, statusOK, resp.Checks["postgres"].Status)
+		assert.Equal(t, statusOK, resp.Checks["rabbitmq"].Status)
+		assert.Equal(t, statusOK, resp.Checks["consumer"].Status)
+		assert.Equal(t, statusOK, resp.Checks["dynamics"].Status)
+		assert.NotNil(t, resp.Checks["dynamics"].AgeSeconds)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Postgres unreachable and AMQP connection closed
+	t.Run("Dependencies down", func(t *testing.T) {
+		state := useHealthState(t)
+		state.SetConsumerActive(true)
+		setupRabbitConn(t, true)
+		setupPingDB(t, errors.New("connection refused"))
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, statusDown, resp.Status)
+		assert.Equal(t, "connection refused", resp.Checks["postgres"].Error)
+		assert.Equal(t, "connection closed", resp.Checks["rabbitmq"].Error)
+		assert.Equal(t, statusOK, resp.Checks["consumer"].Status)
+		assert.Equal(t, statusUnknown, resp.Checks["dynamics"].Status)
+	})
+
+	// Test case 3: Consumer not running
+	t.Run("Consumer inactive", func(t *testing.T) {
+		useHealthState(t)
+		setupRabbitConn(t, false)
+		setupPingDB(t, nil)
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, statusDown, resp.Checks["consumer"].Status)
+	})
+
+	// Test case 4: Failing Dynamics is reported without failing readiness
+	t.Run("Dynamics degraded", func(t *testing.T) {
+		state := useHealthState(t)
+		state.SetConsumerActive(true)
+		state.lastDynamicsOK.Store(time.Now().Add(-time.Minute).UnixNano())
+		state.RecordDynamicsFailure()
+		setupRabbitConn(t, false)
+		setupPingDB(t, nil)
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/readyz")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, statusDegraded, resp.Checks["dynamics"].Status)
+		assert.InDelta(t, 60, *resp.Checks["dynamics"].AgeSeconds, 5)
+	})
+}
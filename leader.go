@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const (
+	// leaderLockKey is the pg_advisory_lock key held by the leader ("dyna").
+	leaderLockKey int64 = 0x64796e61
+
+	defaultLeaderRenewInterval = 10 * time.Second
+	defaultLeaderRetryInterval = 15 * time.Second
+)
+
+var errLeadershipLost = errors.New("advisory lock no longer held")
+
+// RunAsLeader calls run whenever this instance holds the leader advisory lock,
+// until ctx is cancelled. The lock is session scoped, so it is taken on a
+// connection reserved from the db pool for as long as leadership lasts. The
+// lease is renewed every RenewInterval by checking that the session is alive
+// and still holds the lock; if it does not, the context passed to run is
+// cancelled and the election starts over. Instances that are not leader retry
+// every RetryInterval.
+func RunAsLeader(ctx context.Context, cfg Config, run func(context.Context)) {
+	retryInterval := cfg.Leader.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = defaultLeaderRetryInterval
+	}
+
+	for {
+		conn, err := acquireLeaderLock(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Leader election failed", "error", err)
+		}
+		if conn != nil {
+			lead(ctx, cfg, conn, run)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// acquireLeaderLock returns the connection holding the leader lock, or nil
+// when another instance holds it.
+func acquireLeaderLock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func lead(ctx context.Context, cfg Config, conn *sql.Conn, run func(context.Context)) {
+	renewInterval := cfg.Leader.RenewInterval
+	if renewInterval <= 0 {
+		renewInterval = defaultLeaderRenewInterval
+	}
+
+	slog.Info("Acquired leadership", "instance_id", instanceID)
+	health.SetLeader(true)
+	isLeader.Set(1)
+	defer func() {
+		health.SetLeader(false)
+		isLeader.Set(0)
+	}()
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		run(leaderCtx)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			cancel()
+			<-done
+			releaseLeaderLock(conn)
+			slog.Info("Released leadership", "instance_id", instanceID)
+			return
+		case <-done:
+			releaseLeaderLock(conn)
+			return
+		case <-ticker.C:
+			if err := renewLeaderLock(ctx, conn, renewInterval); err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				slog.Warn("Lost leadership, stopping leader-only work", "instance_id", instanceID, "error", err)
+				cancel()
+				<-done
+				discardConn(conn)
+				return
+			}
+		}
+	}
+}
+
+// renewLeaderLock checks that the session is alive and still holds the lock.
+func renewLeaderLock(ctx context.Context, conn *sql.Conn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var held bool
+	err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_locks
+		WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND objid = $1 AND objsubid = 1 AND granted)`, leaderLockKey).Scan(&held)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return errLeadershipLost
+	}
+	return nil
+}
+
+// releaseLeaderLock unlocks and returns the connection to the pool. If the
+// unlock cannot be confirmed the connection is discarded instead, since a pooled
+// session still holding the lock would block every other instance.
+func releaseLeaderLock(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	var released bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", leaderLockKey).Scan(&released)
+	if err != nil || !released {
+		discardConn(conn)
+		return
+	}
+	conn.Close()
+}
+
+// discardConn closes the underlying session rather than returning it to the pool.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func leaderTestConfig() Config {
+	return Config{Leader: LeaderConfig{Enabled: true, RenewInterval: 20 * time.Millisecond, RetryInterval: 20 * time.Millisecond}}
+}
+
+func lockRows(acquired bool) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"result"}).AddRow(acquired)
+}
+
+func TestRunAsLeader(t *testing.T) {
+	// Test case 1: Acquire the lock, run, and release it on shutdown
+	t.Run("Lead until cancelled", func(t *testing.T) {
+		useHealthState(t)
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(leaderLockKey).WillReturnRows(lockRows(true))
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(leaderLockKey).WillReturnRows(lockRows(true))
+		mock.ExpectQuery("SELECT pg_advisory_unlock").WithArgs(leaderLockKey).WillReturnRows(lockRows(true))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		running := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			RunAsLeader(ctx, leaderTestConfig(), func(leaderCtx context.Context) {
+				close(running)
+				<-leaderCtx.Done()
+			})
+			close(done)
+		}()
+
+		select {
+		case <-running:
+		case <-time.After(time.Second):
+			t.Fatal("leader-only work did not start")
+		}
+		assert.Equal(t, statusOK, checkLeader().Status)
+
+		// wait for one lease renewal before shutting down
+		time.Sleep(30 * time.Millisecond)
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("RunAsLeader did not return after cancellation")
+		}
+		assert.Equal(t, statusStandby, checkLeader().Status)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Another instance holds the lock
+	t.Run("Standby while lock is held elsewhere", func(t *testing.T) {
+		useHealthState(t)
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(leaderLockKey).WillReturnRows(lockRows(false))
+		mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(leaderLockKey).WillReturnRows(lockRows(false))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		ran := false
+		go func() {
+			RunAsLeader(ctx, leaderTestConfig(), func(context.Context) { ran = true })
+			close(done)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return mock.ExpectationsWereMet() == nil
+		}, time.Second, 5*time.Millisecond)
+		cancel()
+		<-done
+
+		assert.False(t, ran, "leader-only work must not run without the lock")
+		assert.Equal(t, statusStandby, checkLeader().Status)
+	})
+
+	// Test case 3: Losing the lock stops leader-only work
+	t.Run("Stop on lost lock", func(t *testing.T) {
+		useHealthState(t)
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(leaderLockKey).WillReturnRows(lockRows(true))
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(leaderLockKey).WillReturnError(errors.New("connection reset by peer"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			RunAsLeader(ctx, leaderTestConfig(), func(leaderCtx context.Context) {
+				<-leaderCtx.Done()
+				close(stopped)
+			})
+			close(done)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("leader-only work was not stopped after losing the lock")
+		}
+		cancel()
+		<-done
+
+		assert.Equal(t, statusStandby, checkLeader().Status)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestHealthzLeaderElection(t *testing.T) {
+	// Test case 1: A standby instance does not poll but is healthy
+	t.Run("Standby", func(t *testing.T) {
+		state := useHealthState(t)
+		state.EnableLeaderElection()
+		state.lastPoll.Store(time.Now().Add(-time.Hour).UnixNano())
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/healthz")
+		assert.Equal(t, 200, code)
+		assert.Equal(t, statusStandby, resp.Checks["poll_loop"].Status)
+		assert.Equal(t, statusStandby, resp.Checks["leader"].Status)
+	})
+
+	// Test case 2: The leader's poll loop is checked as usual
+	t.Run("Leader with stalled poll loop", func(t *testing.T) {
+		state := useHealthState(t)
+		state.EnableLeaderElection()
+		state.SetLeader(true)
+		state.lastPoll.Store(time.Now().Add(-time.Hour).UnixNano())
+
+		code, resp := getHealth(t, newHTTPHandler(Config{}), "/healthz")
+		assert.Equal(t, 503, code)
+		assert.Equal(t, statusDown, resp.Checks["poll_loop"].Status)
+		assert.Equal(t, statusOK, resp.Checks["leader"].Status)
+		assert.NotNil(t, resp.Checks["leader"].LastSeen)
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func InitLogger(cfg Config) {
+	logger := slog.New(newLogHandler(os.Stdout, cfg.Log)).With(
+		"app", cfg.AppName,
+		"version", cfg.AppVersion,
+		"environment", cfg.Environment,
+	)
+	slog.SetDefault(logger)
+}
+
+func newLogHandler(w io.Writer, cfg LogConfig) slog.Handler {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(cfg.Level)}
+	if strings.EqualFold(cfg.Format, "text") {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// orderLogger returns a logger that tags every line with the order's
+// identifiers and the correlation ID that follows it through the pipeline.
+func orderLogger(po PurchaseOrder) *slog.Logger {
+	return slog.With(
+		"po_id", po.ID,
+		"vendor_id", po.VendorID,
+		"correlation_id", po.CorrelationID,
+	)
+}
+
+// fatal logs at error level and exits, standing in for log.Fatal.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	osExit(1)
+}
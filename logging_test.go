@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// captureLogs routes the default slog logger into a JSON buffer for the test.
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	original := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { slog.SetDefault(original) })
+	return &buf
+}
+
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestNewLogHandler(t *testing.T) {
+	// Test case 1: JSON output filtered by level
+	t.Run("JSON handler with level", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(newLogHandler(&buf, LogConfig{Level: "warn", Format: "json"}))
+
+		logger.Info("dropped")
+		logger.Warn("kept", "po_id", "PO1")
+
+		lines := decodeLogLines(t, &buf)
+		assert.Len(t, lines, 1)
+		assert.Equal(t, "kept", lines[0]["msg"])
+		assert.Equal(t, "PO1", lines[0]["po_id"])
+	})
+
+	// Test case 2: Text output
+	t.Run("Text handler", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(newLogHandler(&buf, LogConfig{Level: "debug", Format: "text"}))
+
+		logger.Debug("hello", "po_id", "PO1")
+		assert.Contains(t, buf.String(), "level=DEBUG")
+		assert.Contains(t, buf.String(), "po_id=PO1")
+	})
+}
+
+func TestParseLogLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, parseLogLevel("DEBUG"))
+	assert.Equal(t, slog.LevelWarn, parseLogLevel("warning"))
+	assert.Equal(t, slog.LevelError, parseLogLevel("error"))
+	assert.Equal(t, slog.LevelInfo, parseLogLevel(""))
+}
+
+func TestCorrelationIDPropagation(t *testing.T) {
+	t.Run("Consumer logs carry the published correlation ID", func(t *testing.T) {
+		buf := captureLogs(t, slog.LevelDebug)
+
+		mockChannel := setupMockChannel(t)
+		expectTopology(mockChannel, defaultRetryDelay)
+		mockChannel.On("Publish", "purchase_orders.dlx", "purchase_orders", true, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+			return msg.CorrelationId == "corr-42"
+		})).Return(nil)
+
+		dbMock := setupMockDB(t)
+		dbMock.ExpectQuery("UPDATE purchase_orders SET sync_status").WithArgs("PO42", SyncStatusSyncing, int64(0)).
+			WillReturnError(assert.AnError)
+
+		acknowledger := new(MockAcknowledger)
+		acknowledger.On("Ack", uint64(1), false).Return(nil)
+
+		runConsumer(t, mockChannel, Config{}, amqp.Delivery{
+			Acknowledger:  acknowledger,
+			DeliveryTag:   1,
+			CorrelationId: "corr-42",
+			Body:          []byte(`{"id":"PO42","vendor_id":"V042"}`),
+		})
+
+		var failure map[string]interface{}
+		for _, line := range decodeLogLines(t, buf) {
+			if line["msg"] == "Sync failed, dead-lettering" {
+				failure = line
+			}
+		}
+		if assert.NotNil(t, failure) {
+			assert.Equal(t, "PO42", failure["po_id"])
+			assert.Equal(t, "V042", failure["vendor_id"])
+			assert.Equal(t, "corr-42", failure["correlation_id"])
+		}
+		mockChannel.AssertExpectations(t)
+	})
+}
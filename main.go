@@ -1,33 +1,211 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+const (
+	pollInterval        = 30 * time.Second
+	defaultDrainTimeout = 30 * time.Second
+)
+
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the subcommands need only the database, not the service's environment
 	cfg := Config{}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		cfg.LoadDatabaseConfig("config")
+		InitLogger(cfg)
+		InitDB(cfg)
+		err := runMigrateCommand(ctx, os.Args[2:], os.Stdout)
+		CloseDB()
+		if err != nil {
+			fatal("Migration failed", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "conflicts" {
+		cfg.LoadDatabaseConfig("config")
+		InitLogger(cfg)
+		InitDB(cfg)
+		err := runConflictsCommand(ctx, os.Args[2:], os.Stdout)
+		CloseDB()
+		if err != nil {
+			fatal("Conflicts command failed", err)
+		}
+		return
+	}
+
 	cfg.LoadConfig("config")
+	InitLogger(cfg)
+
+	if cfg.Poll.Mode != pollModeInterval && cfg.Poll.Mode != pollModeNotify && cfg.Poll.Mode != pollModeCDC {
+		fatal("Invalid poll mode", fmt.Errorf("unknown mode %q", cfg.Poll.Mode))
+	}
 
 	InitDB(cfg)
-	InitRabbitMQ(cfg)
-	go ConsumeQueue(cfg)
+	if cfg.Database.AutoMigrate {
+		if _, err := MigrateUp(ctx); err != nil {
+			fatal("Failed to migrate database", err)
+		}
+	}
+	InitRabbitMQ(ctx, cfg)
+	InitDynamics(cfg)
+	StartHTTPServer(ctx, cfg)
+
+	consumerDone := make(chan struct{})
+	go func() {
+		ConsumeQueue(ctx, cfg)
+		close(consumerDone)
+	}()
+	ledgerDone := make(chan struct{})
+	go func() {
+		PruneMessageLedger(ctx, cfg)
+		close(ledgerDone)
+	}()
+
+	if cfg.Leader.Enabled {
+		health.EnableLeaderElection()
+		RunAsLeader(ctx, cfg, func(leaderCtx context.Context) {
+			PublishApprovedOrders(leaderCtx, cfg)
+		})
+	} else {
+		PublishApprovedOrders(ctx, cfg)
+	}
+
+	slog.Info("Shutting down, waiting for in-flight messages")
+	<-consumerDone
+	<-ledgerDone
+	CloseRabbitMQ()
+	CloseDB()
+	slog.Info("Shutdown complete")
+}
+
+// PublishApprovedOrders runs the poller, or in cdc mode the replication
+// stream, which moves approved orders into the outbox, and the relay, which
+// publishes the outbox to RabbitMQ, until ctx is cancelled.
+func PublishApprovedOrders(ctx context.Context, cfg Config) {
+	relayDone := make(chan struct{})
+	go func() {
+		RelayOutbox(ctx, cfg)
+		close(relayDone)
+	}()
+
+	if cfg.Poll.Mode == pollModeCDC {
+		CaptureOrderChanges(ctx, cfg)
+	} else {
+		PollPendingOrders(ctx, cfg)
+	}
+	<-relayDone
+}
+
+// PollPendingOrders queues approved orders in the outbox until ctx is
+// cancelled, fetching them every poll interval or, in notify mode, as soon as
+// Postgres signals an approval and on every sweep interval.
+func PollPendingOrders(ctx context.Context, cfg Config) {
+	var approved <-chan struct{}
+	if cfg.Poll.Mode == pollModeNotify {
+		approved = listenForApprovedOrders(ctx, cfg)
+	}
+	interval := fetchInterval(cfg)
 
 	for {
-		log.Println("Fetching purchase orders for sync...")
-		orders, err := FetchPendingOrders()
-		if err != nil {
-			log.Printf("Error fetching orders: %v", err)
+		health.RecordPoll()
+		if pollOnce(ctx, cfg) && ctx.Err() == nil {
 			continue
 		}
 
-		for _, order := range orders {
-			err := PublishToQueue(order)
-			if err != nil {
-				log.Printf("Failed to publish order %s to queue: %v", order.ID, err)
-				ReportErrorToGlitchTip(cfg, order.ID, err)
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case <-approved:
+		case <-time.After(interval):
 		}
-		time.Sleep(30 * time.Second)
+	}
+}
+
+// fetchInterval is the longest PollPendingOrders waits between fetches.
+func fetchInterval(cfg Config) time.Duration {
+	if cfg.Poll.Mode == pollModeNotify {
+		if cfg.Poll.SweepInterval > 0 {
+			return cfg.Poll.SweepInterval
+		}
+		return defaultSweepInterval
+	}
+	if cfg.Poll.Interval > 0 {
+		return cfg.Poll.Interval
+	}
+	return pollInterval
+}
+
+// pollOnce queues one batch of claimed orders and reports whether the batch
+// was full, meaning more orders are probably waiting and can be fetched
+// straight away.
+func pollOnce(ctx context.Context, cfg Config) bool {
+	start := time.Now()
+	defer func() { pollDuration.Observe(time.Since(start).Seconds()) }()
+
+	slog.Debug("Fetching purchase orders for sync")
+	orders, err := EnqueuePendingOrders(ctx, cfg)
+	if err != nil {
+		slog.Error("Error queueing orders", "error", err)
+		return false
+	}
+	recordPendingOrders(ctx)
+	if len(orders) == 0 {
+		return false
+	}
+
+	recordQueuedOrders(orders)
+
+	return len(orders) >= claimBatchSize(cfg)
+}
+
+// recordQueuedOrders counts and logs orders written to the outbox and wakes
+// the relay to publish them.
+func recordQueuedOrders(orders []PurchaseOrder) {
+	slog.Info("Queued purchase orders for sync", "count", len(orders))
+	for _, order := range orders {
+		ordersFetched.WithLabelValues(order.VendorID).Inc()
+		orderLogger(order).Debug("Queued order in outbox")
+	}
+	notifyOutbox()
+}
+
+// recordPendingOrders sets the pending orders gauge to the backlog still
+// waiting in the database.
+func recordPendingOrders(ctx context.Context) {
+	count, err := CountPendingOrders(ctx)
+	if err != nil {
+		slog.Error("Error counting pending orders", "error", err)
+		return
+	}
+	pendingOrders.Set(float64(count))
+}
+
+// drainContext returns a context that survives the cancellation of ctx by up
+// to timeout, so work that was already under way can complete on shutdown.
+func drainContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, cancel)
+	})
+
+	return workCtx, func() {
+		stop()
+		cancel()
 	}
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainContext(t *testing.T) {
+	// Test case 1: Work context outlives the parent until the timeout
+	t.Run("Cancelled after drain timeout", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		workCtx, stop := drainContext(ctx, 50*time.Millisecond)
+		defer stop()
+
+		cancel()
+		assert.NoError(t, workCtx.Err())
+
+		select {
+		case <-workCtx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("work context was not cancelled after the drain timeout")
+		}
+	})
+
+	// Test case 2: Stop cancels the work context immediately
+	t.Run("Cancelled by stop", func(t *testing.T) {
+		workCtx, stop := drainContext(context.Background(), time.Hour)
+		stop()
+		assert.Error(t, workCtx.Err())
+	})
+}
+
+func TestPollPendingOrders(t *testing.T) {
+	t.Run("Return after cancellation", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersQuery).
+			WillReturnRows(sqlmock.NewRows(orderColumns))
+		mock.ExpectRollback()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() {
+			PollPendingOrders(ctx, Config{})
+			done <- true
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("PollPendingOrders did not return after cancellation")
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("Fetch on approval notification", func(t *testing.T) {
+		listener := newFakeOrderListener()
+		useFakeOrderListener(t, listener)
+
+		mock := setupMockDB(t)
+		for i := 0; i < 2; i++ {
+			mock.ExpectBegin()
+			mock.ExpectQuery(claimOrdersQuery).
+				WillReturnRows(sqlmock.NewRows(orderColumns))
+			mock.ExpectRollback()
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() {
+			PollPendingOrders(ctx, Config{Poll: PollConfig{Mode: pollModeNotify, SweepInterval: time.Hour}})
+			done <- true
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		listener.notifications <- &pq.Notification{Channel: approvedOrdersChannel, Extra: "PO001"}
+
+		assert.Eventually(t, func() bool {
+			return mock.ExpectationsWereMet() == nil
+		}, time.Second, 10*time.Millisecond, "approval notification did not trigger a fetch")
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("PollPendingOrders did not return after cancellation")
+		}
+	})
+}
+
+func TestFetchInterval(t *testing.T) {
+	assert.Equal(t, pollInterval, fetchInterval(Config{}))
+	assert.Equal(t, 10*time.Second, fetchInterval(Config{Poll: PollConfig{Mode: pollModeInterval, Interval: 10 * time.Second}}))
+	assert.Equal(t, defaultSweepInterval, fetchInterval(Config{Poll: PollConfig{Mode: pollModeNotify, Interval: 10 * time.Second}}))
+	assert.Equal(t, time.Minute, fetchInterval(Config{Poll: PollConfig{Mode: pollModeNotify, SweepInterval: time.Minute}}))
+}
+
+func TestPollOnce(t *testing.T) {
+	orderRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(orderColumns).AddRow("PO001", "V001", "100.50", "USD", SyncActionCreate, 1)
+	}
+	cfg := Config{Poll: PollConfig{BatchSize: 1}}
+
+	// Test case 1: A full batch is queued in the outbox and asks for an immediate refetch
+	t.Run("Full batch queued", func(t *testing.T) {
+		dbMock := setupMockDB(t)
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(claimOrdersQuery).WillReturnRows(orderRows())
+		dbMock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+		dbMock.ExpectExec("INSERT INTO outbox").
+			WithArgs("PO001", eventOrderApproved, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		dbMock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs(pq.Array([]string{"PO001"}), SyncStatusQueued).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectCommit()
+		dbMock.ExpectQuery(pendingCountQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+
+		select {
+		case <-outboxReady:
+		default:
+		}
+
+		assert.True(t, pollOnce(context.Background(), cfg))
+		assert.Equal(t, float64(4), testutil.ToFloat64(pendingOrders), "gauge reports the backlog, not the batch")
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+
+		select {
+		case <-outboxReady:
+		default:
+			t.Fatal("relay was not woken after queueing orders")
+		}
+	})
+
+	// Test case 2: A failed outbox write rolls back the claim and waits for the next poll
+	t.Run("Outbox failure rolls back", func(t *testing.T) {
+		dbMock := setupMockDB(t)
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(claimOrdersQuery).WillReturnRows(orderRows())
+		dbMock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+		dbMock.ExpectExec("INSERT INTO outbox").WillReturnError(errors.New("disk full"))
+		dbMock.ExpectRollback()
+
+		assert.False(t, pollOnce(context.Background(), cfg))
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	// Test case 3: An order amended right after it was queued is claimed by the next poll
+	t.Run("Amended right after queueing", func(t *testing.T) {
+		dbMock := setupMockDB(t)
+		expectQueued := func(eventType string) {
+			dbMock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+			dbMock.ExpectExec("INSERT INTO outbox").
+				WithArgs("PO001", eventType, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			// the claim is released with the queued status, so the lease does not hide the amendment
+			dbMock.ExpectExec(regexp.QuoteMeta(markQueuedQuery)).
+				WithArgs(pq.Array([]string{"PO001"}), SyncStatusQueued).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			dbMock.ExpectCommit()
+			dbMock.ExpectQuery(pendingCountQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		}
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(claimOrdersQuery).WillReturnRows(orderRows())
+		expectQueued(eventOrderApproved)
+		pollOnce(context.Background(), cfg)
+
+		// the amendment trigger puts the order back to pending with the update action
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(claimOrdersQuery).
+			WillReturnRows(sqlmock.NewRows(orderColumns).AddRow("PO001", "V001", "120.00", "USD", SyncActionUpdate, 2))
+		expectQueued(eventOrderUpdated)
+		pollOnce(context.Background(), cfg)
+
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Event types carried in the envelope and the AMQP type property. An approved
+// event creates the order in Dynamics; updated and cancelled events follow
+// when the order is amended or cancelled afterwards.
+const (
+	eventOrderApproved  = "purchase_order.approved"
+	eventOrderUpdated   = "purchase_order.updated"
+	eventOrderCancelled = "purchase_order.cancelled"
+)
+
+// orderEvents maps each sync action to the event type it is published as.
+var orderEvents = map[string]string{
+	SyncActionCreate: eventOrderApproved,
+	SyncActionUpdate: eventOrderUpdated,
+	SyncActionCancel: eventOrderCancelled,
+}
+
+// orderEventType returns the event type for the order's pending action.
+func orderEventType(po PurchaseOrder) string {
+	if eventType, ok := orderEvents[po.Action]; ok {
+		return eventType
+	}
+	return eventOrderApproved
+}
+
+// orderAction returns the sync action an event type carries.
+func orderAction(eventType string) string {
+	for action, t := range orderEvents {
+		if t == eventType {
+			return action
+		}
+	}
+	return SyncActionCreate
+}
+
+const (
+	currentSchemaVersion = 1
+	schemaVersionHeader  = "x-schema-version"
+)
+
+var errUnsupportedMessage = errors.New("unsupported message type or schema version")
+
+// messageEnvelope wraps every message published to the work queue. Data holds
+// the event payload, whose shape is fixed by Type and SchemaVersion.
+type messageEnvelope struct {
+	MessageID     string          `json:"message_id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	ProducedAt    time.Time       `json:"produced_at"`
+	Source        messageSource   `json:"source"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+type messageSource struct {
+	App     string `json:"app"`
+	Version string `json:"version"`
+}
+
+type messageKind struct {
+	Type          string
+	SchemaVersion int
+}
+
+// messageDecoders maps each event type and schema version this consumer
+// understands to the decoder for its data. Anything else is parked.
+var messageDecoders = map[messageKind]func(data json.RawMessage) (PurchaseOrder, error){
+	{eventOrderApproved, 1}:  decodeOrderV1,
+	{eventOrderUpdated, 1}:   decodeOrderV1,
+	{eventOrderCancelled, 1}: decodeOrderV1,
+}
+
+func decodeOrderV1(data json.RawMessage) (PurchaseOrder, error) {
+	var po PurchaseOrder
+	err := json.Unmarshal(data, &po)
+	return po, err
+}
+
+// newOrderEnvelope wraps order as a current-version event of the given type.
+func newOrderEnvelope(cfg Config, eventType string, order PurchaseOrder) (messageEnvelope, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return messageEnvelope{}, err
+	}
+
+	return messageEnvelope{
+		MessageID:     newRandomID(),
+		Type:          eventType,
+		SchemaVersion: currentSchemaVersion,
+		ProducedAt:    time.Now().UTC(),
+		Source:        messageSource{App: cfg.AppName, Version: cfg.AppVersion},
+		CorrelationID: order.CorrelationID,
+		Data:          data,
+	}, nil
+}
+
+// publishing mirrors the envelope metadata in the AMQP properties, so brokers
+// and tools can see it without parsing the body.
+func (e messageEnvelope) publishing() (amqp.Publishing, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	return amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     e.MessageID,
+		CorrelationId: e.CorrelationID,
+		Type:          e.Type,
+		Timestamp:     e.ProducedAt,
+		AppId:         e.Source.App,
+		Headers:       amqp.Table{schemaVersionHeader: int32(e.SchemaVersion)},
+		Body:          body,
+	}, nil
+}
+
+// decodeMessage unwraps a delivery into the purchase order it carries, with
+// the action its event type stands for. It returns errUnsupportedMessage for
+// event types or schema versions this consumer does not know, and a plain
+// error for bodies that cannot be parsed. Bodies without an envelope are read
+// as a bare order to create, as published before the envelope was introduced.
+func decodeMessage(msg amqp.Delivery) (PurchaseOrder, messageEnvelope, error) {
+	var env messageEnvelope
+	if err := json.Unmarshal(msg.Body, &env); err != nil {
+		return PurchaseOrder{}, env, err
+	}
+
+	if env.Type == "" && env.SchemaVersion == 0 && env.Data == nil {
+		po, err := decodeOrderV1(msg.Body)
+		po.Action = SyncActionCreate
+		env.MessageID = msg.MessageId
+		env.CorrelationID = msg.CorrelationId
+		return po, env, err
+	}
+
+	decode, ok := messageDecoders[messageKind{env.Type, env.SchemaVersion}]
+	if !ok {
+		return PurchaseOrder{}, env, fmt.Errorf("%w: %s v%d", errUnsupportedMessage, env.Type, env.SchemaVersion)
+	}
+	po, err := decode(env.Data)
+	po.Action = orderAction(env.Type)
+	return po, env, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func envelopeDelivery(t *testing.T, env messageEnvelope) amqp.Delivery {
+	msg, err := env.publishing()
+	assert.NoError(t, err)
+	return amqp.Delivery{
+		MessageId:     msg.MessageId,
+		CorrelationId: msg.CorrelationId,
+		Type:          msg.Type,
+		Headers:       msg.Headers,
+		Body:          msg.Body,
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	order := PurchaseOrder{ID: "PO123", VendorID: "V001", Amount: decimal.RequireFromString("100.50"), Currency: "USD", CorrelationID: "corr-1"}
+	cfg := Config{AppName: "dynaproc", AppVersion: "1.2.3"}
+
+	// Test case 1: Current envelope
+	t.Run("Envelope round trip", func(t *testing.T) {
+		env, err := newOrderEnvelope(cfg, eventOrderApproved, order)
+		assert.NoError(t, err)
+
+		po, decoded, err := decodeMessage(envelopeDelivery(t, env))
+		assert.NoError(t, err)
+		assert.Equal(t, "PO123", po.ID)
+		assert.Equal(t, "100.50", po.Amount.StringFixed(2))
+		assert.Equal(t, env.MessageID, decoded.MessageID)
+		assert.Equal(t, "corr-1", decoded.CorrelationID)
+		assert.Equal(t, messageSource{App: "dynaproc", Version: "1.2.3"}, decoded.Source)
+	})
+
+	// Test case 2: Bare order published before the envelope existed
+	t.Run("Legacy body", func(t *testing.T) {
+		body, _ := json.Marshal(order)
+		assert.Contains(t, string(body), `"amount":"100.5"`)
+		po, env, err := decodeMessage(amqp.Delivery{MessageId: "msg-1", CorrelationId: "corr-2", Body: body})
+		assert.NoError(t, err)
+		assert.Equal(t, "PO123", po.ID)
+		assert.Equal(t, SyncActionCreate, po.Action)
+		assert.Equal(t, "msg-1", env.MessageID)
+		assert.Equal(t, "corr-2", env.CorrelationID)
+	})
+
+	// Test case 3: Unknown schema versions and event types are not parsed
+	t.Run("Unsupported message", func(t *testing.T) {
+		env, _ := newOrderEnvelope(cfg, eventOrderApproved, order)
+		env.SchemaVersion = 2
+		_, _, err := decodeMessage(envelopeDelivery(t, env))
+		assert.ErrorIs(t, err, errUnsupportedMessage)
+		assert.Contains(t, err.Error(), "purchase_order.approved v2")
+
+		env, _ = newOrderEnvelope(cfg, "purchase_order.archived", order)
+		_, _, err = decodeMessage(envelopeDelivery(t, env))
+		assert.ErrorIs(t, err, errUnsupportedMessage)
+	})
+
+	// Test case 4: Amendments and cancellations carry their action and version
+	t.Run("Update and cancel events", func(t *testing.T) {
+		changed := order
+		changed.Version = 3
+		for eventType, action := range map[string]string{
+			eventOrderApproved:  SyncActionCreate,
+			eventOrderUpdated:   SyncActionUpdate,
+			eventOrderCancelled: SyncActionCancel,
+		} {
+			env, err := newOrderEnvelope(cfg, eventType, changed)
+			assert.NoError(t, err)
+
+			po, _, err := decodeMessage(envelopeDelivery(t, env))
+			assert.NoError(t, err)
+			assert.Equal(t, action, po.Action, eventType)
+			assert.Equal(t, int64(3), po.Version, eventType)
+		}
+	})
+
+	// Test case 5: Bodies that are not JSON
+	t.Run("Unparseable body", func(t *testing.T) {
+		_, _, err := decodeMessage(amqp.Delivery{Body: []byte("not json")})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, errUnsupportedMessage)
+	})
+}
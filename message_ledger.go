@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultLedgerRetention     = 7 * 24 * time.Hour
+	defaultLedgerPruneInterval = time.Hour
+)
+
+// IsMessageProcessed reports whether the message ledger records messageID as
+// synced. Redeliveries and republished outbox rows keep their message ID, so
+// they are recognised here before Dynamics is called.
+func IsMessageProcessed(ctx context.Context, messageID string) (bool, error) {
+	var processed bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM processed_messages WHERE message_id = $1)", messageID).Scan(&processed)
+	return processed, err
+}
+
+// RecordProcessedMessage adds messageID to the ledger once its order is synced.
+func RecordProcessedMessage(ctx context.Context, messageID, poID string) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO processed_messages (message_id, purchase_order_id) VALUES ($1, $2) ON CONFLICT (message_id) DO NOTHING",
+		messageID, poID)
+	return err
+}
+
+// PruneMessageLedger deletes ledger entries older than the retention window
+// every prune interval until ctx is cancelled. The window must outlast the
+// time a message can spend in the retry queue and the outbox, after which a
+// duplicate is still caught by the Dynamics lookup.
+func PruneMessageLedger(ctx context.Context, cfg Config) {
+	interval := cfg.Ledger.PruneInterval
+	if interval <= 0 {
+		interval = defaultLedgerPruneInterval
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		pruned, err := pruneMessageLedger(ctx, ledgerRetention(cfg))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Failed to prune message ledger", "error", err)
+			}
+			continue
+		}
+		if pruned > 0 {
+			slog.Debug("Pruned message ledger", "count", pruned)
+		}
+	}
+}
+
+func pruneMessageLedger(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM processed_messages WHERE processed_at < NOW() - $1 * INTERVAL '1 second'", retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func ledgerRetention(cfg Config) time.Duration {
+	if cfg.Ledger.Retention > 0 {
+		return cfg.Ledger.Retention
+	}
+	return defaultLedgerRetention
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageLedger(t *testing.T) {
+	// Test case 1: Look up a processed message
+	t.Run("Message processed", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM processed_messages WHERE message_id = \\$1\\)").
+			WithArgs("msg-1").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		processed, err := IsMessageProcessed(context.Background(), "msg-1")
+		assert.NoError(t, err)
+		assert.True(t, processed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Record a message, ignoring one that is already recorded
+	t.Run("Record message", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectExec("INSERT INTO processed_messages \\(message_id, purchase_order_id\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT \\(message_id\\) DO NOTHING").
+			WithArgs("msg-1", "PO001").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		assert.NoError(t, RecordProcessedMessage(context.Background(), "msg-1", "PO001"))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 3: Entries older than the retention window are pruned
+	t.Run("Prune expired entries", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectExec("DELETE FROM processed_messages WHERE processed_at < NOW\\(\\) - \\$1 \\* INTERVAL '1 second'").
+			WithArgs(float64(3600)).
+			WillReturnResult(sqlmock.NewResult(0, 4))
+
+		pruned, err := pruneMessageLedger(context.Background(), time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), pruned)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 4: The pruner keeps running after a failure and stops on cancellation
+	t.Run("Prune until cancelled", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectExec("DELETE FROM processed_messages").WillReturnError(errors.New("connection reset"))
+		mock.ExpectExec("DELETE FROM processed_messages").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() {
+			PruneMessageLedger(ctx, Config{Ledger: LedgerConfig{PruneInterval: 10 * time.Millisecond}})
+			done <- true
+		}()
+
+		assert.Eventually(t, func() bool {
+			return mock.ExpectationsWereMet() == nil
+		}, time.Second, 10*time.Millisecond)
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("PruneMessageLedger did not return after cancellation")
+		}
+	})
+}
+
+func TestLedgerRetention(t *testing.T) {
+	assert.Equal(t, defaultLedgerRetention, ledgerRetention(Config{}))
+	assert.Equal(t, time.Hour, ledgerRetention(Config{Ledger: LedgerConfig{Retention: time.Hour}}))
+}
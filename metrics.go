@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Failure classes used as the "class" label on ordersFailed.
+const (
+	failureParse       = "parse"
+	failureUnsupported = "unsupported_message"
+	failureCanceled    = "canceled"
+	failureTimeout     = "timeout"
+	failureNetwork     = "network"
+	failureDatabase    = "database"
+	failureBroker      = "broker"
+	failureThrottled   = "dynamics_throttled"
+	failureCircuitOpen = "circuit_open"
+	failureDynamics4xx = "dynamics_4xx"
+	failureDynamics5xx = "dynamics_5xx"
+	failureConflict    = "dynamics_conflict"
+	failureOther       = "other"
+	unknownVendor      = "unknown"
+)
+
+var (
+	ordersFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynaproc_orders_fetched_total",
+		Help: "Purchase orders fetched from Postgres for publishing.",
+	}, []string{"vendor"})
+
+	ordersPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynaproc_orders_published_total",
+		Help: "Purchase orders published to RabbitMQ and confirmed by the broker.",
+	}, []string{"vendor"})
+
+	ordersConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynaproc_orders_consumed_total",
+		Help: "Purchase order messages received from RabbitMQ.",
+	}, []string{"vendor"})
+
+	ordersSynced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynaproc_orders_synced_total",
+		Help: "Purchase orders successfully synced to Dynamics 365.",
+	}, []string{"vendor"})
+
+	ordersFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynaproc_orders_failed_total",
+		Help: "Purchase order failures by pipeline stage and failure class.",
+	}, []string{"stage", "class", "vendor"})
+
+	messagesDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dynaproc_messages_duplicate_total",
+		Help: "Messages acknowledged without syncing because the ledger shows they were processed.",
+	})
+
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dynaproc_dynamics_sync_duration_seconds",
+		Help:    "Latency of purchase order requests to Dynamics 365.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"outcome"})
+
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dynaproc_leader",
+		Help: "1 while this instance holds the leader lock and runs the poller, 0 otherwise.",
+	})
+
+	dynamicsThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynaproc_dynamics_throttled_total",
+		Help: "Requests Dynamics 365 rejected with 429 or 503, by status code.",
+	}, []string{"status"})
+
+	dynamicsThrottleWait = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dynaproc_dynamics_throttle_wait_seconds_total",
+		Help: "Total Retry-After delay requested by Dynamics 365.",
+	})
+
+	dynamicsCircuitState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dynaproc_dynamics_circuit_state",
+		Help: "State of the Dynamics 365 circuit breaker: 0 closed, 1 half-open, 2 open.",
+	})
+
+	pollDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dynaproc_poll_duration_seconds",
+		Help:    "Time taken to fetch and publish one batch of pending orders.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	pendingOrders = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dynaproc_pending_orders",
+		Help: "Purchase orders with a change waiting to be queued for sync.",
+	})
+
+	consumerInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dynaproc_consumer_in_flight",
+		Help: "Messages currently being processed by the consumer.",
+	})
+)
+
+func recordFailure(stage, vendor string, err error) {
+	if vendor == "" {
+		vendor = unknownVendor
+	}
+	ordersFailed.WithLabelValues(stage, failureClass(err), vendor).Inc()
+}
+
+func failureClass(err error) string {
+	var apiErr *DynamicsAPIError
+	var conflict *DynamicsConflictError
+	var netErr net.Error
+	var pqErr *pq.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return failureCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return failureTimeout
+	case errors.Is(err, errCircuitOpen):
+		return failureCircuitOpen
+	case errors.As(err, &conflict):
+		return failureConflict
+	case errors.As(err, &apiErr):
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			return failureThrottled
+		}
+		if apiErr.StatusCode >= 500 {
+			return failureDynamics5xx
+		}
+		return failureDynamics4xx
+	case errors.Is(err, errPublishNacked), errors.Is(err, errPublishTimeout), errors.Is(err, errConfirmsClosed), errors.Is(err, errMessageReturned):
+		return failureBroker
+	case errors.As(err, &pqErr), errors.Is(err, sql.ErrConnDone), errors.Is(err, sql.ErrNoRows):
+		return failureDatabase
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return failureTimeout
+		}
+		return failureNetwork
+	default:
+		return failureOther
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFailureClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"Canceled", context.Canceled, failureCanceled},
+		{"Deadline exceeded", fmt.Errorf("post: %w", context.DeadlineExceeded), failureTimeout},
+		{"Dynamics client error", &DynamicsAPIError{StatusCode: 400, Status: "400 Bad Request"}, failureDynamics4xx},
+		{"Dynamics throttled", fmt.Errorf("post line 1: %w", &DynamicsAPIError{StatusCode: 429, Status: "429 Too Many Requests"}), failureThrottled},
+		{"Dynamics server error", &DynamicsAPIError{StatusCode: 503, Status: "503 Service Unavailable"}, failureDynamics5xx},
+		{"Broker nack", errPublishNacked, failureBroker},
+		{"Unroutable", fmt.Errorf("%w: 312 NO_ROUTE", errMessageReturned), failureBroker},
+		{"Postgres error", &pq.Error{Code: "57P01"}, failureDatabase},
+		{"Connection done", sql.ErrConnDone, failureDatabase},
+		{"Dynamics conflict", &DynamicsConflictError{DynamicsID: "DYN-001"}, failureConflict},
+		{"Other", errors.New("boom"), failureOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, failureClass(tt.err))
+		})
+	}
+}
+
+func TestSyncMetrics(t *testing.T) {
+	t.Run("Count synced and failed orders", func(t *testing.T) {
+		status := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		mockChannel := setupMockChannel(t)
+		expectTopology(mockChannel, defaultRetryDelay)
+
+		dbMock := setupMockDB(t)
+		expectMarkSyncing(dbMock, "PO1", "")
+		dbMock.ExpectExec("UPDATE purchase_orders SET sync_status").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		acknowledger := new(MockAcknowledger)
+		acknowledger.On("Ack", uint64(1), false).Return(nil)
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL}}
+		synced := testutil.ToFloat64(ordersSynced.WithLabelValues("V-METRICS"))
+		failed := testutil.ToFloat64(ordersFailed.WithLabelValues("sync", failureDynamics5xx, "V-METRICS"))
+
+		runConsumer(t, mockChannel, cfg, amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: []byte(`{"id":"PO1","vendor_id":"V-METRICS"}`)})
+		assert.Equal(t, synced+1, testutil.ToFloat64(ordersSynced.WithLabelValues("V-METRICS")))
+
+		status = http.StatusBadGateway
+		mockChannel = setupMockChannel(t)
+		expectTopology(mockChannel, defaultRetryDelay)
+		mockChannel.On("Publish", "purchase_orders.dlx", "purchase_orders", true, false, mock.Anything).Return(nil)
+		expectMarkSyncing(dbMock, "PO2", "")
+		dbMock.ExpectExec("UPDATE purchase_orders SET sync_status").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		runConsumer(t, mockChannel, cfg, amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: []byte(`{"id":"PO2","vendor_id":"V-METRICS"}`)})
+		assert.Equal(t, failed+1, testutil.ToFloat64(ordersFailed.WithLabelValues("sync", failureDynamics5xx, "V-METRICS")))
+		assert.Equal(t, float64(0), testutil.ToFloat64(consumerInFlight))
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ordersFetched.WithLabelValues("V001").Inc()
+
+	rec := httptest.NewRecorder()
+	newHTTPHandler(Config{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, string(body), `dynaproc_orders_fetched_total{vendor="V001"}`)
+	assert.Contains(t, string(body), "dynaproc_consumer_in_flight")
+}
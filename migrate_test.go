@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectMigrationSession expects the lock, bookkeeping table and applied
+// version lookup that precede every migration command.
+func expectMigrationSession(mock sqlmock.Sqlmock, applied ...int64) {
+	mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(migrationLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	}
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").WillReturnRows(rows)
+}
+
+func expectMigrationUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(migrationLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, int64(i+1), m.Version, "migration versions must be contiguous")
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+	assert.Equal(t, "create_purchase_orders", migrations[0].Name)
+
+	// the business tables are never dropped by rolling back
+	assert.NotContains(t, migrations[0].Down, "DROP")
+	assert.NotContains(t, migrations[2].Down, "DROP")
+}
+
+func TestMigrateUp(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := migrations[len(migrations)-1]
+	secondLast := migrations[len(migrations)-2]
+
+	var applied []int64
+	for _, m := range migrations[:len(migrations)-2] {
+		applied = append(applied, m.Version)
+	}
+
+	// Test case 1: Apply only the pending migrations
+	t.Run("Apply pending migrations", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMigrationSession(mock, applied...)
+		for _, m := range []migration{secondLast, last} {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(m.Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(m.Version, m.Name).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+		expectMigrationUnlock(mock)
+
+		n, err := MigrateUp(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: A failing script is rolled back and stops the run
+	t.Run("Failing migration", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMigrationSession(mock, applied...)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(secondLast.Up)).WillReturnError(errors.New("syntax error"))
+		mock.ExpectRollback()
+		expectMigrationUnlock(mock)
+
+		n, err := MigrateUp(context.Background())
+		assert.ErrorContains(t, err, "syntax error")
+		assert.Equal(t, 0, n)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 3: Nothing to do
+	t.Run("Up to date", func(t *testing.T) {
+		mock := setupMockDB(t)
+		var all []int64
+		for _, m := range migrations {
+			all = append(all, m.Version)
+		}
+		expectMigrationSession(mock, all...)
+		expectMigrationUnlock(mock)
+
+		n, err := MigrateUp(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestMigrateDown(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var all []int64
+	for _, m := range migrations {
+		all = append(all, m.Version)
+	}
+
+	mock := setupMockDB(t)
+	expectMigrationSession(mock, all...)
+	for _, m := range []migration{migrations[len(migrations)-1], migrations[len(migrations)-2]} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(m.Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(m.Version).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	expectMigrationUnlock(mock)
+
+	n, err := MigrateDown(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	// Test case 1: Status lists applied and pending migrations
+	t.Run("Status", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMigrationSession(mock, 1)
+		expectMigrationUnlock(mock)
+
+		var out bytes.Buffer
+		err := runMigrateCommand(context.Background(), []string{"status"}, &out)
+		assert.NoError(t, err)
+		assert.Regexp(t, `0001\s+create_purchase_orders\s+2024-05-01T10:00:00Z`, out.String())
+		assert.Regexp(t, `0002\s+add_sync_state\s+pending`, out.String())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Invalid arguments
+	t.Run("Invalid arguments", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.ErrorContains(t, runMigrateCommand(context.Background(), nil, &out), "usage")
+		assert.ErrorContains(t, runMigrateCommand(context.Background(), []string{"sideways"}, &out), "unknown migrate command")
+		assert.ErrorContains(t, runMigrateCommand(context.Background(), []string{"down", "zero"}, &out), "invalid number of steps")
+		assert.ErrorContains(t, runMigrateCommand(context.Background(), []string{"down", "0"}, &out), "invalid number of steps")
+	})
+}
@@ -0,0 +1,2 @@
+-- purchase_orders holds the business's orders and may have existed before this
+-- migration, so rolling it back leaves the table and its data in place.
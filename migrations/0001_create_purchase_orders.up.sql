@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS purchase_orders (
+    id        TEXT PRIMARY KEY,
+    vendor_id TEXT NOT NULL,
+    amount    NUMERIC(19, 4) NOT NULL,
+    currency  CHAR(3) NOT NULL,
+    status    TEXT NOT NULL,
+    synced    BOOLEAN NOT NULL DEFAULT FALSE
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS purchase_orders_pending_idx;
+
+ALTER TABLE purchase_orders
+    DROP COLUMN IF EXISTS sync_error,
+    DROP COLUMN IF EXISTS synced_at,
+    DROP COLUMN IF EXISTS dynamics_id,
+    DROP COLUMN IF EXISTS sync_status;
@@ -0,0 +1,12 @@
+ALTER TABLE purchase_orders
+    ADD COLUMN IF NOT EXISTS sync_status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (sync_status IN ('pending', 'queued', 'syncing', 'synced', 'failed')),
+    ADD COLUMN IF NOT EXISTS dynamics_id TEXT,
+    ADD COLUMN IF NOT EXISTS synced_at   TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS sync_error  TEXT;
+
+-- orders synced before the sync state existed must not be published again
+UPDATE purchase_orders SET sync_status = 'synced' WHERE synced;
+
+CREATE INDEX IF NOT EXISTS purchase_orders_pending_idx
+    ON purchase_orders (id) WHERE status = 'APPROVED' AND sync_status = 'pending';
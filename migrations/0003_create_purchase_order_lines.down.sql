@@ -0,0 +1,3 @@
+-- purchase_order_lines holds the business's order lines and may have existed
+-- before this migration, so rolling it back leaves the table and its data in
+-- place.
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS purchase_order_lines (
+    purchase_order_id TEXT NOT NULL REFERENCES purchase_orders (id) ON DELETE CASCADE,
+    line_number       INTEGER NOT NULL,
+    item_number       TEXT NOT NULL,
+    description       TEXT,
+    quantity          NUMERIC(19, 4) NOT NULL,
+    unit              TEXT NOT NULL,
+    unit_price        NUMERIC(19, 6) NOT NULL,
+    line_amount       NUMERIC(19, 4) NOT NULL,
+    delivery_date     DATE,
+    site              TEXT,
+    warehouse         TEXT,
+    PRIMARY KEY (purchase_order_id, line_number)
+);
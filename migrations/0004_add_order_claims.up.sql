@@ -0,0 +1,3 @@
+ALTER TABLE purchase_orders
+    ADD COLUMN IF NOT EXISTS claimed_by    TEXT,
+    ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
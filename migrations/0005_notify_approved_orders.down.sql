@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS purchase_orders_approved ON purchase_orders;
+DROP FUNCTION IF EXISTS notify_purchase_order_approved();
@@ -0,0 +1,15 @@
+-- Signals POLL_MODE=notify instances whenever a purchase order becomes
+-- approved and is waiting to be synced. The payload is the order ID.
+CREATE OR REPLACE FUNCTION notify_purchase_order_approved() RETURNS trigger AS $$
+BEGIN
+    IF NEW.status = 'APPROVED' AND NEW.sync_status = 'pending' THEN
+        PERFORM pg_notify('purchase_orders_approved', NEW.id::text);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS purchase_orders_approved ON purchase_orders;
+CREATE TRIGGER purchase_orders_approved
+    AFTER INSERT OR UPDATE OF status, sync_status ON purchase_orders
+    FOR EACH ROW EXECUTE FUNCTION notify_purchase_order_approved();
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS cdc_offsets;
+DROP PUBLICATION IF EXISTS dynaproc_purchase_orders;
@@ -0,0 +1,17 @@
+-- Publishes changes to purchase orders and their lines for POLL_MODE=cdc. The
+-- replication slot itself is created by the service on first start.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = 'dynaproc_purchase_orders') THEN
+        CREATE PUBLICATION dynaproc_purchase_orders FOR TABLE purchase_orders, purchase_order_lines;
+    END IF;
+END
+$$;
+
+-- The last position of each replication slot whose changes are in the outbox,
+-- written in the same transaction as the outbox rows.
+CREATE TABLE IF NOT EXISTS cdc_offsets (
+    slot_name     TEXT PRIMARY KEY,
+    confirmed_lsn TEXT NOT NULL,
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
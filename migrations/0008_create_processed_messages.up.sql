@@ -0,0 +1,10 @@
+-- Message IDs whose orders were synced to Dynamics, so a redelivered or
+-- republished message is acknowledged without calling Dynamics again. Rows
+-- older than MESSAGE_LEDGER_RETENTION are pruned by the service.
+CREATE TABLE IF NOT EXISTS processed_messages (
+    message_id        TEXT PRIMARY KEY,
+    purchase_order_id TEXT NOT NULL,
+    processed_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS processed_messages_processed_at_idx ON processed_messages (processed_at);
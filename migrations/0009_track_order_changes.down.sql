@@ -0,0 +1,18 @@
+CREATE OR REPLACE FUNCTION notify_purchase_order_approved() RETURNS trigger AS $$
+BEGIN
+    IF NEW.status = 'APPROVED' AND NEW.sync_status = 'pending' THEN
+        PERFORM pg_notify('purchase_orders_approved', NEW.id::text);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS purchase_order_lines_changed ON purchase_order_lines;
+DROP FUNCTION IF EXISTS queue_purchase_order_line_change();
+DROP TRIGGER IF EXISTS purchase_orders_changed ON purchase_orders;
+DROP FUNCTION IF EXISTS queue_purchase_order_change();
+
+DROP INDEX IF EXISTS purchase_orders_cancel_pending_idx;
+ALTER TABLE purchase_orders
+    DROP COLUMN IF EXISTS sync_version,
+    DROP COLUMN IF EXISTS sync_action;
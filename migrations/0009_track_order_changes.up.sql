@@ -0,0 +1,64 @@
+-- Amendments and cancellations of orders that were already handed to the sync
+-- pipeline put the order back in the pending state with the action to send.
+-- sync_version is bumped with each of them and travels with the event, so a
+-- consumer can drop an event that was overtaken by a newer one.
+ALTER TABLE purchase_orders
+    ADD COLUMN IF NOT EXISTS sync_action  TEXT NOT NULL DEFAULT 'create'
+        CHECK (sync_action IN ('create', 'update', 'cancel')),
+    ADD COLUMN IF NOT EXISTS sync_version BIGINT NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS purchase_orders_cancel_pending_idx
+    ON purchase_orders (id) WHERE sync_action = 'cancel' AND sync_status = 'pending';
+
+CREATE OR REPLACE FUNCTION queue_purchase_order_change() RETURNS trigger AS $$
+BEGIN
+    -- not sent yet, the create event will carry the latest state
+    IF OLD.sync_status = 'pending' AND OLD.sync_action = 'create' THEN
+        RETURN NEW;
+    END IF;
+
+    IF NEW.status = 'CANCELLED' AND OLD.status IS DISTINCT FROM 'CANCELLED' THEN
+        NEW.sync_action := 'cancel';
+    ELSIF NEW.status = 'APPROVED'
+        AND (NEW.vendor_id, NEW.amount, NEW.currency) IS DISTINCT FROM (OLD.vendor_id, OLD.amount, OLD.currency) THEN
+        NEW.sync_action := 'update';
+    ELSE
+        RETURN NEW;
+    END IF;
+
+    NEW.sync_status := 'pending';
+    NEW.sync_version := OLD.sync_version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS purchase_orders_changed ON purchase_orders;
+CREATE TRIGGER purchase_orders_changed
+    BEFORE UPDATE OF status, vendor_id, amount, currency ON purchase_orders
+    FOR EACH ROW EXECUTE FUNCTION queue_purchase_order_change();
+
+CREATE OR REPLACE FUNCTION queue_purchase_order_line_change() RETURNS trigger AS $$
+BEGIN
+    UPDATE purchase_orders
+    SET sync_action = 'update', sync_status = 'pending', sync_version = sync_version + 1
+    WHERE id = COALESCE(NEW.purchase_order_id, OLD.purchase_order_id)
+        AND status = 'APPROVED'
+        AND NOT (sync_status = 'pending' AND sync_action = 'create');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS purchase_order_lines_changed ON purchase_order_lines;
+CREATE TRIGGER purchase_order_lines_changed
+    AFTER INSERT OR UPDATE OR DELETE ON purchase_order_lines
+    FOR EACH ROW EXECUTE FUNCTION queue_purchase_order_line_change();
+
+-- cancellations are signalled to POLL_MODE=notify instances as well
+CREATE OR REPLACE FUNCTION notify_purchase_order_approved() RETURNS trigger AS $$
+BEGIN
+    IF NEW.sync_status = 'pending' AND (NEW.status = 'APPROVED' OR NEW.sync_action = 'cancel') THEN
+        PERFORM pg_notify('purchase_orders_approved', NEW.id::text);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS sync_conflicts;
+
+UPDATE purchase_orders SET sync_status = 'failed' WHERE sync_status = 'conflict';
+
+ALTER TABLE purchase_orders DROP CONSTRAINT IF EXISTS purchase_orders_sync_status_check;
+ALTER TABLE purchase_orders ADD CONSTRAINT purchase_orders_sync_status_check
+    CHECK (sync_status IN ('pending', 'queued', 'syncing', 'synced', 'failed'));
+
+ALTER TABLE purchase_orders DROP COLUMN IF EXISTS dynamics_etag;
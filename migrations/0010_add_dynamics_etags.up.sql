@@ -0,0 +1,27 @@
+-- The ETag of the order header as Dynamics last returned it. Updates are sent
+-- with If-Match, so an order edited in Dynamics since then is not overwritten.
+ALTER TABLE purchase_orders ADD COLUMN IF NOT EXISTS dynamics_etag TEXT;
+
+ALTER TABLE purchase_orders DROP CONSTRAINT IF EXISTS purchase_orders_sync_status_check;
+ALTER TABLE purchase_orders ADD CONSTRAINT purchase_orders_sync_status_check
+    CHECK (sync_status IN ('pending', 'queued', 'syncing', 'synced', 'failed', 'conflict'));
+
+-- Updates Dynamics rejected because the order was edited there. Each row waits
+-- for someone to decide, with "dynaproc conflicts resolve", whether our
+-- version overwrites the one in Dynamics or is dropped in its favour.
+CREATE TABLE IF NOT EXISTS sync_conflicts (
+    id                BIGSERIAL PRIMARY KEY,
+    purchase_order_id TEXT NOT NULL,
+    sync_version      BIGINT NOT NULL,
+    message_id        TEXT,
+    dynamics_id       TEXT NOT NULL,
+    expected_etag     TEXT NOT NULL,
+    current_etag      TEXT,
+    payload           JSONB NOT NULL,
+    detected_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at       TIMESTAMPTZ,
+    resolution        TEXT CHECK (resolution IN ('overwrite', 'keep'))
+);
+
+CREATE INDEX IF NOT EXISTS sync_conflicts_unresolved_idx
+    ON sync_conflicts (purchase_order_id) WHERE resolved_at IS NULL;
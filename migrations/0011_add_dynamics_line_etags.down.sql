@@ -0,0 +1,3 @@
+ALTER TABLE sync_conflicts DROP COLUMN IF EXISTS current_line_etags;
+
+DROP TABLE IF EXISTS dynamics_order_lines;
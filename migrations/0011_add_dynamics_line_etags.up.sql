@@ -0,0 +1,13 @@
+-- The ETag of each order line as Dynamics last returned it. Before an order is
+-- updated its lines in Dynamics are compared with these, so a line edited,
+-- added or removed there since the last sync is a conflict rather than being
+-- overwritten or deleted.
+CREATE TABLE IF NOT EXISTS dynamics_order_lines (
+    purchase_order_id TEXT NOT NULL REFERENCES purchase_orders (id) ON DELETE CASCADE,
+    line_number       INTEGER NOT NULL,
+    etag              TEXT NOT NULL,
+    PRIMARY KEY (purchase_order_id, line_number)
+);
+
+-- line number to ETag of the lines Dynamics had when the conflict was detected
+ALTER TABLE sync_conflicts ADD COLUMN IF NOT EXISTS current_line_etags JSONB;
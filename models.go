@@ -1,8 +1,72 @@
 package main
 
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Sync states a purchase order moves through on its way to Dynamics 365.
+const (
+	SyncStatusPending = "pending"
+	SyncStatusQueued  = "queued"
+	SyncStatusSyncing = "syncing"
+	SyncStatusSynced  = "synced"
+	SyncStatusFailed  = "failed"
+
+	// SyncStatusConflict marks an order whose update was rejected because it
+	// was edited in Dynamics; it waits in sync_conflicts for a decision.
+	SyncStatusConflict = "conflict"
+)
+
+// Sync actions record which change to a purchase order is waiting to be sent.
+// An order is created once approved; later amendments and cancellations of an
+// order already handed to the pipeline are sent as updates and cancellations.
+const (
+	SyncActionCreate = "create"
+	SyncActionUpdate = "update"
+	SyncActionCancel = "cancel"
+)
+
+// PurchaseOrder amounts are exact decimals scanned from NUMERIC columns. They
+// are marshalled as decimal strings without trailing zeros, e.g. "100.5" for
+// 100.5000, so no precision is lost on the queue.
 type PurchaseOrder struct {
-	ID       string  `json:"id"`
-	VendorID string  `json:"vendor_id"`
-	Amount   float64 `json:"amount"`
-	Currency string  `json:"currency"`
+	ID       string          `json:"id"`
+	VendorID string          `json:"vendor_id"`
+	Amount   decimal.Decimal `json:"amount"`
+	Currency string          `json:"currency"`
+
+	Lines []PurchaseOrderLine `json:"lines"`
+
+	// Version increases with every amendment or cancellation, so a consumer
+	// can tell an event that was overtaken by a newer one. Zero for messages
+	// published before versions existed.
+	Version int64 `json:"version,omitempty"`
+
+	// Action is carried by the event type rather than the message body.
+	Action string `json:"-"`
+
+	// CorrelationID is assigned when the order is fetched and travels in the
+	// AMQP correlation_id property rather than the message body.
+	CorrelationID string `json:"-"`
+
+	// MessageID identifies the message the order was consumed from, for the
+	// idempotency ledger.
+	MessageID string `json:"-"`
+}
+
+// PurchaseOrderLine is a single item on a purchase order. Optional columns are
+// left at their zero value when unset in the database.
+type PurchaseOrderLine struct {
+	LineNumber   int             `json:"line_number"`
+	ItemNumber   string          `json:"item_number"`
+	Description  string          `json:"description"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	Unit         string          `json:"unit"`
+	UnitPrice    decimal.Decimal `json:"unit_price"`
+	LineAmount   decimal.Decimal `json:"line_amount"`
+	DeliveryDate *time.Time      `json:"delivery_date,omitempty"`
+	Site         string          `json:"site"`
+	Warehouse    string          `json:"warehouse"`
 }
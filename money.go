@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// defaultMinorUnits is the number of decimal places used for currencies
+// without an entry in currencyMinorUnits.
+const defaultMinorUnits = 2
+
+// currencyMinorUnits lists the ISO 4217 currencies whose minor unit differs
+// from the usual two decimal places.
+var currencyMinorUnits = map[string]int32{
+	"BHD": 3,
+	"BIF": 0,
+	"CLP": 0,
+	"DJF": 0,
+	"GNF": 0,
+	"IDR": 0,
+	"IQD": 3,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KMF": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"PYG": 0,
+	"RWF": 0,
+	"TND": 3,
+	"UGX": 0,
+	"VND": 0,
+	"VUV": 0,
+	"XAF": 0,
+	"XOF": 0,
+	"XPF": 0,
+}
+
+// minorUnits returns the number of decimal places amounts in currency are
+// expressed in.
+func minorUnits(currency string) int32 {
+	if units, ok := currencyMinorUnits[strings.ToUpper(currency)]; ok {
+		return units
+	}
+	return defaultMinorUnits
+}
+
+// RoundMoney rounds amount half away from zero to the minor unit of currency.
+func RoundMoney(amount decimal.Decimal, currency string) decimal.Decimal {
+	return amount.Round(minorUnits(currency))
+}
+
+// moneyJSON renders amount rounded to the minor unit of currency with all of
+// its decimal places, e.g. 100.50, as a JSON number literal.
+func moneyJSON(amount decimal.Decimal, currency string) json.Number {
+	return json.Number(RoundMoney(amount, currency).StringFixed(minorUnits(currency)))
+}
+
+// jsonDecimal renders d as a JSON number literal without going through
+// float64, so the exact value reaches the receiving side.
+func jsonDecimal(d decimal.Decimal) json.Number {
+	return json.Number(d.String())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundMoney(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     string
+	}{
+		{"100.505", "USD", "100.51"},
+		{"100.504", "usd", "100.5"},
+		{"-0.125", "EUR", "-0.13"},
+		{"1234.5", "JPY", "1235"},
+		{"1.2345", "KWD", "1.235"},
+		{"19.999", "XYZ", "20"},
+	}
+
+	for _, tt := range tests {
+		got := RoundMoney(decimal.RequireFromString(tt.amount), tt.currency)
+		assert.Equal(t, tt.want, got.String(), "%s %s", tt.amount, tt.currency)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	assert.Equal(t, json.Number("100.50"), moneyJSON(decimal.RequireFromString("100.5"), "USD"))
+	assert.Equal(t, json.Number("1235"), moneyJSON(decimal.RequireFromString("1234.5"), "JPY"))
+	assert.Equal(t, json.Number("1.200"), moneyJSON(decimal.RequireFromString("1.2"), "BHD"))
+
+	sum := decimal.RequireFromString("0.1").Add(decimal.RequireFromString("0.2"))
+	payload, err := json.Marshal(map[string]interface{}{"TotalAmount": moneyJSON(sum, "USD")})
+	assert.NoError(t, err)
+	assert.Contains(t, string(payload), "0.30")
+}
+
+func TestPurchaseOrderJSONAmounts(t *testing.T) {
+	// Test case 1: Amounts are marshalled as exact decimal strings
+	t.Run("Marshal as decimal strings", func(t *testing.T) {
+		po := PurchaseOrder{
+			ID:       "PO001",
+			Amount:   decimal.RequireFromString("0.30"),
+			Currency: "USD",
+			Lines:    []PurchaseOrderLine{{LineNumber: 1, Quantity: decimal.RequireFromString("2.5"), UnitPrice: decimal.RequireFromString("0.12345"), LineAmount: decimal.RequireFromString("0.31")}},
+		}
+
+		body, err := json.Marshal(po)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), `"amount":"0.3"`)
+		assert.Contains(t, string(body), `"unit_price":"0.12345"`)
+
+		var decoded PurchaseOrder
+		assert.NoError(t, json.Unmarshal(body, &decoded))
+		assert.True(t, po.Amount.Equal(decoded.Amount))
+		assert.True(t, po.Lines[0].UnitPrice.Equal(decoded.Lines[0].UnitPrice))
+	})
+
+	// Test case 2: Messages queued with float amounts are still accepted
+	t.Run("Unmarshal numeric amounts", func(t *testing.T) {
+		var decoded PurchaseOrder
+		assert.NoError(t, json.Unmarshal([]byte(`{"id":"PO001","amount":100.1,"currency":"USD"}`), &decoded))
+		assert.Equal(t, "100.1", decoded.Amount.String())
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	pollModeInterval = "interval"
+	pollModeNotify   = "notify"
+
+	approvedOrdersChannel = "purchase_orders_approved"
+	defaultSweepInterval  = 5 * time.Minute
+
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+	listenerPingInterval = time.Minute
+)
+
+// orderListener is the subset of pq.Listener used to wait for approvals.
+type orderListener interface {
+	Listen(channel string) error
+	Notifications() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+type pqOrderListener struct {
+	*pq.Listener
+}
+
+func (l pqOrderListener) Notifications() <-chan *pq.Notification {
+	return l.Notify
+}
+
+// newOrderListener opens a dedicated LISTEN connection, separate from the db
+// pool, which pq re-establishes on its own after a connection loss.
+var newOrderListener = func(cfg Config) orderListener {
+	listener := pq.NewListener(databaseDSN(cfg), listenerMinReconnect, listenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventDisconnected:
+				slog.Warn("Order listener disconnected", "error", err)
+			case pq.ListenerEventReconnected:
+				slog.Info("Order listener reconnected")
+			case pq.ListenerEventConnectionAttemptFailed:
+				slog.Warn("Order listener failed to connect", "error", err)
+			}
+		})
+	return pqOrderListener{listener}
+}
+
+// listenForApprovedOrders signals on the returned channel whenever Postgres
+// notifies that an order was approved, and after the listener reconnects since
+// notifications sent while it was down are lost. Bursts of notifications are
+// coalesced into a single signal. The listener is closed when ctx is cancelled.
+func listenForApprovedOrders(ctx context.Context, cfg Config) <-chan struct{} {
+	wake := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	listener := newOrderListener(cfg)
+	context.AfterFunc(ctx, func() { listener.Close() })
+
+	go func() {
+		if err := listener.Listen(approvedOrdersChannel); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Failed to listen for approved orders, relying on sweeps", "channel", approvedOrdersChannel, "error", err)
+			}
+			return
+		}
+		slog.Info("Listening for approved orders", "channel", approvedOrdersChannel)
+
+		ping := time.NewTicker(listenerPingInterval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n, ok := <-listener.Notifications():
+				if !ok {
+					return
+				}
+				if n == nil {
+					slog.Info("Order listener reconnected, sweeping for missed approvals")
+				} else {
+					slog.Debug("Received order approval notification", "po_id", n.Extra)
+				}
+				signal()
+			case <-ping.C:
+				if err := listener.Ping(); err != nil {
+					slog.Warn("Order listener ping failed", "error", err)
+				}
+			}
+		}
+	}()
+
+	return wake
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOrderListener struct {
+	mu            sync.Mutex
+	listenErr     error
+	channels      []string
+	notifications chan *pq.Notification
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newFakeOrderListener() *fakeOrderListener {
+	return &fakeOrderListener{
+		notifications: make(chan *pq.Notification, 10),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (l *fakeOrderListener) Listen(channel string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.channels = append(l.channels, channel)
+	return l.listenErr
+}
+
+func (l *fakeOrderListener) Notifications() <-chan *pq.Notification {
+	return l.notifications
+}
+
+func (l *fakeOrderListener) Ping() error {
+	return nil
+}
+
+func (l *fakeOrderListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// useFakeOrderListener makes newOrderListener return listener for the duration of the test.
+func useFakeOrderListener(t *testing.T, listener *fakeOrderListener) {
+	original := newOrderListener
+	newOrderListener = func(Config) orderListener { return listener }
+	t.Cleanup(func() { newOrderListener = original })
+}
+
+func waitForWake(t *testing.T, wake <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-wake:
+	case <-time.After(time.Second):
+		t.Fatal("listener did not signal")
+	}
+}
+
+func assertNoWake(t *testing.T, wake <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-wake:
+		t.Fatal("unexpected signal")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestListenForApprovedOrders(t *testing.T) {
+	// Test case 1: A notification wakes the poller
+	t.Run("Signal on notification", func(t *testing.T) {
+		listener := newFakeOrderListener()
+		useFakeOrderListener(t, listener)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		wake := listenForApprovedOrders(ctx, Config{})
+
+		listener.notifications <- &pq.Notification{Channel: approvedOrdersChannel, Extra: "PO001"}
+		waitForWake(t, wake)
+
+		listener.mu.Lock()
+		assert.Equal(t, []string{approvedOrdersChannel}, listener.channels)
+		listener.mu.Unlock()
+	})
+
+	// Test case 2: Bursts are coalesced into one signal
+	t.Run("Coalesce bursts", func(t *testing.T) {
+		listener := newFakeOrderListener()
+		useFakeOrderListener(t, listener)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		wake := listenForApprovedOrders(ctx, Config{})
+
+		for _, id := range []string{"PO001", "PO002", "PO003"} {
+			listener.notifications <- &pq.Notification{Channel: approvedOrdersChannel, Extra: id}
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		waitForWake(t, wake)
+		assertNoWake(t, wake)
+	})
+
+	// Test case 3: A reconnect triggers a sweep for missed notifications
+	t.Run("Signal after reconnect", func(t *testing.T) {
+		listener := newFakeOrderListener()
+		useFakeOrderListener(t, listener)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		wake := listenForApprovedOrders(ctx, Config{})
+
+		listener.notifications <- nil
+		waitForWake(t, wake)
+	})
+
+	// Test case 4: Listen fails, leaving only the sweeps
+	t.Run("Listen error", func(t *testing.T) {
+		listener := newFakeOrderListener()
+		listener.listenErr = errors.New("permission denied")
+		useFakeOrderListener(t, listener)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		wake := listenForApprovedOrders(ctx, Config{})
+
+		listener.notifications <- &pq.Notification{Channel: approvedOrdersChannel, Extra: "PO001"}
+		assertNoWake(t, wake)
+	})
+
+	// Test case 5: The listener is closed on cancellation
+	t.Run("Close on cancellation", func(t *testing.T) {
+		listener := newFakeOrderListener()
+		useFakeOrderListener(t, listener)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		listenForApprovedOrders(ctx, Config{})
+		cancel()
+
+		select {
+		case <-listener.closed:
+		case <-time.After(time.Second):
+			t.Fatal("listener was not closed")
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultRelayInterval       = 5 * time.Second
+	defaultOutboxBatchSize     = 100
+	defaultOutboxRetryDelay    = time.Second
+	defaultOutboxMaxRetryDelay = 5 * time.Minute
+)
+
+// outboxReady wakes the relay when orders have been queued, so they are
+// published without waiting for the relay interval.
+var outboxReady = make(chan struct{}, 1)
+
+func notifyOutbox() {
+	select {
+	case outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+// outboxEvent is an undispatched outbox row.
+type outboxEvent struct {
+	ID          int64
+	AggregateID string
+	Attempts    int
+	Envelope    messageEnvelope
+}
+
+// EnqueuePendingOrders claims orders with a pending change and, in the same
+// transaction, writes an event for each to the outbox and marks it queued. A
+// crash at any point either leaves the orders pending or leaves them queued
+// with their messages waiting in the outbox; the relay publishes them from
+// there.
+func EnqueuePendingOrders(ctx context.Context, cfg Config) ([]PurchaseOrder, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	orders, err := FetchPendingOrders(ctx, tx, cfg)
+	if err != nil || len(orders) == 0 {
+		return nil, err
+	}
+	if err := queueOrders(ctx, tx, cfg, orders); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// queueOrders writes an event for the pending action of each claimed order to
+// the outbox and marks the orders queued, as part of the caller's transaction.
+func queueOrders(ctx context.Context, q dbQuerier, cfg Config, orders []PurchaseOrder) error {
+	ids := make([]string, len(orders))
+	for i, order := range orders {
+		env, err := newOrderEnvelope(cfg, orderEventType(order), order)
+		if err != nil {
+			return err
+		}
+		if err := insertOutboxEvent(ctx, q, order.ID, env); err != nil {
+			return err
+		}
+		ids[i] = order.ID
+	}
+	return MarkOrdersQueued(ctx, q, ids)
+}
+
+func insertOutboxEvent(ctx context.Context, q dbQuerier, aggregateID string, env messageEnvelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "INSERT INTO outbox (aggregate_id, event_type, payload) VALUES ($1, $2, $3)",
+		aggregateID, env.Type, payload)
+	return err
+}
+
+// RelayOutbox publishes outbox rows to RabbitMQ until ctx is cancelled, when
+// woken by the poller and every relay interval. A batch that is being
+// published when ctx is cancelled is given up to cfg.DrainTimeout to record
+// which rows were dispatched.
+func RelayOutbox(ctx context.Context, cfg Config) {
+	workCtx, cancel := drainContext(ctx, cfg.DrainTimeout)
+	defer cancel()
+
+	interval := cfg.Outbox.RelayInterval
+	if interval <= 0 {
+		interval = defaultRelayInterval
+	}
+
+	for {
+		dispatched, err := relayOnce(ctx, workCtx, cfg)
+		if err != nil {
+			slog.Error("Error relaying outbox", "error", err)
+		}
+		if err == nil && dispatched >= outboxBatchSize(cfg) && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-outboxReady:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// relayOnce publishes one batch of due outbox rows with publisher confirms and
+// records each outcome, returning how many rows were dispatched. The rows stay
+// locked until the batch is committed, so relays on several instances never
+// publish the same row; a crash after publishing but before the commit
+// publishes the row again, making delivery at-least-once. A row is skipped
+// while an earlier row for the same purchase order is undispatched, so one
+// order's messages are published in the order they were written.
+func relayOnce(ctx, workCtx context.Context, cfg Config) (int, error) {
+	tx, err := db.BeginTx(workCtx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	events, err := fetchOutboxEvents(workCtx, tx, outboxBatchSize(cfg))
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	if _, err := currentChannel().QueueDeclare(purchaseOrderQueue, true, false, false, false, nil); err != nil {
+		return 0, err
+	}
+
+	dispatched := 0
+	blocked := map[string]bool{}
+	for _, event := range events {
+		if ctx.Err() != nil {
+			break
+		}
+		if blocked[event.AggregateID] {
+			continue
+		}
+
+		if err := publishOutboxEvent(workCtx, cfg, tx, event); err != nil {
+			blocked[event.AggregateID] = true
+			continue
+		}
+		dispatched++
+	}
+
+	return dispatched, tx.Commit()
+}
+
+func fetchOutboxEvents(ctx context.Context, tx *sql.Tx, limit int) ([]outboxEvent, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, aggregate_id, attempts, payload FROM outbox o
+		WHERE dispatched_at IS NULL AND next_attempt_at <= NOW()
+			AND NOT EXISTS (
+				SELECT 1 FROM outbox earlier
+				WHERE earlier.aggregate_id = o.aggregate_id AND earlier.dispatched_at IS NULL AND earlier.id < o.id
+			)
+		ORDER BY id LIMIT $1
+		FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []outboxEvent
+	for rows.Next() {
+		var event outboxEvent
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.AggregateID, &event.Attempts, &payload); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &event.Envelope); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// publishOutboxEvent publishes one row and marks it dispatched, or schedules
+// its next attempt when the broker did not confirm it.
+func publishOutboxEvent(ctx context.Context, cfg Config, tx *sql.Tx, event outboxEvent) error {
+	var order PurchaseOrder
+	json.Unmarshal(event.Envelope.Data, &order)
+	order.CorrelationID = event.Envelope.CorrelationID
+	logger := orderLogger(order).With("outbox_id", event.ID)
+
+	msg, err := event.Envelope.publishing()
+	if err == nil {
+		err = publish(ctx, cfg, "", purchaseOrderQueue, msg)
+	}
+	if err != nil {
+		delay := outboxRetryDelay(cfg.Outbox, event.Attempts)
+		logger.Error("Failed to publish outbox event", "attempt", event.Attempts+1, "retry_in", delay, "error", err)
+		recordFailure("publish", order.VendorID, err)
+		if event.Attempts == 0 {
+			ReportErrorToGlitchTip(cfg, order, err)
+		}
+		if _, dbErr := tx.ExecContext(ctx, "UPDATE outbox SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second', last_error = $3 WHERE id = $1",
+			event.ID, delay.Seconds(), err.Error()); dbErr != nil {
+			logger.Error("Failed to record outbox attempt", "error", dbErr)
+		}
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE outbox SET attempts = attempts + 1, dispatched_at = NOW(), last_error = NULL WHERE id = $1", event.ID); err != nil {
+		return err
+	}
+	ordersPublished.WithLabelValues(order.VendorID).Inc()
+	logger.Debug("Published order to queue")
+	return nil
+}
+
+func outboxBatchSize(cfg Config) int {
+	if cfg.Outbox.BatchSize > 0 {
+		return cfg.Outbox.BatchSize
+	}
+	return defaultOutboxBatchSize
+}
+
+// outboxRetryDelay doubles the retry delay for every failed attempt, up to
+// the configured maximum.
+func outboxRetryDelay(cfg OutboxConfig, attempts int) time.Duration {
+	delay := cfg.RetryDelay
+	if delay <= 0 {
+		delay = defaultOutboxRetryDelay
+	}
+	max := cfg.MaxRetryDelay
+	if max <= 0 {
+		max = defaultOutboxMaxRetryDelay
+	}
+
+	for i := 0; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// outboxEventsQuery matches the statement relayOnce locks due outbox rows with.
+const outboxEventsQuery = `SELECT id, aggregate_id, attempts, payload FROM outbox o\s+WHERE dispatched_at IS NULL AND next_attempt_at <= NOW\(\)`
+
+var outboxColumns = []string{"id", "aggregate_id", "attempts", "payload"}
+
+// envelopeArg matches an outbox payload carrying the given event for poID.
+type envelopeArg struct {
+	eventType string
+	poID      string
+}
+
+func (a envelopeArg) Match(v driver.Value) bool {
+	payload, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	var env messageEnvelope
+	var order PurchaseOrder
+	if json.Unmarshal(payload, &env) != nil || json.Unmarshal(env.Data, &order) != nil {
+		return false
+	}
+	return env.Type == a.eventType && env.SchemaVersion == currentSchemaVersion && env.MessageID != "" && order.ID == a.poID
+}
+
+func outboxPayload(t *testing.T, cfg Config, order PurchaseOrder) []byte {
+	env, err := newOrderEnvelope(cfg, eventOrderApproved, order)
+	assert.NoError(t, err)
+	payload, err := json.Marshal(env)
+	assert.NoError(t, err)
+	return payload
+}
+
+func TestEnqueuePendingOrders(t *testing.T) {
+	orderRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(orderColumns).
+			AddRow("PO001", "V001", "100.50", "USD", SyncActionCreate, 1).
+			AddRow("PO002", "V002", "200.75", "EUR", SyncActionCreate, 1)
+	}
+
+	// Test case 1: Claimed orders are written to the outbox and queued in one transaction
+	t.Run("Queue claimed orders", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersQuery).WillReturnRows(orderRows())
+		mock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+		mock.ExpectExec("INSERT INTO outbox").
+			WithArgs("PO001", eventOrderApproved, envelopeArg{eventOrderApproved, "PO001"}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO outbox").
+			WithArgs("PO002", eventOrderApproved, envelopeArg{eventOrderApproved, "PO002"}).
+			WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs(pq.Array([]string{"PO001", "PO002"}), SyncStatusQueued).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		orders, err := EnqueuePendingOrders(context.Background(), Config{})
+		assert.NoError(t, err)
+		assert.Len(t, orders, 2)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Nothing to claim
+	t.Run("No pending orders", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersQuery).WillReturnRows(sqlmock.NewRows(orderColumns))
+		mock.ExpectRollback()
+
+		orders, err := EnqueuePendingOrders(context.Background(), Config{})
+		assert.NoError(t, err)
+		assert.Empty(t, orders)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 3: A failure marking the orders queued rolls back their claims and outbox rows
+	t.Run("Rollback on failure", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersQuery).WillReturnRows(orderRows())
+		mock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+		mock.ExpectExec("INSERT INTO outbox").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO outbox").WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+
+		orders, err := EnqueuePendingOrders(context.Background(), Config{})
+		assert.Error(t, err)
+		assert.Nil(t, orders)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 4: Amended and cancelled orders are queued as update and cancel events
+	t.Run("Queue changes", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOrdersQuery).WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow("PO001", "V001", "120.00", "USD", SyncActionUpdate, 2).
+			AddRow("PO002", "V002", "200.75", "EUR", SyncActionCancel, 3))
+		mock.ExpectQuery("SELECT purchase_order_id, line_number").WillReturnRows(sqlmock.NewRows(orderLineColumns))
+		mock.ExpectExec("INSERT INTO outbox").
+			WithArgs("PO001", eventOrderUpdated, envelopeArg{eventOrderUpdated, "PO001"}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO outbox").
+			WithArgs("PO002", eventOrderCancelled, envelopeArg{eventOrderCancelled, "PO002"}).
+			WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs(pq.Array([]string{"PO001", "PO002"}), SyncStatusQueued).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		orders, err := EnqueuePendingOrders(context.Background(), Config{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), orders[0].Version)
+		assert.Equal(t, SyncActionCancel, orders[1].Action)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRelayOnce(t *testing.T) {
+	cfg := Config{AppName: "dynaproc", AppVersion: "1.2.3"}
+	order := PurchaseOrder{
+		ID:            "PO123",
+		VendorID:      "V001",
+		Amount:        decimal.RequireFromString("100.50"),
+		Currency:      "USD",
+		CorrelationID: "corr-123",
+	}
+
+	// Test case 1: Rows are published with their envelope and marked dispatched
+	t.Run("Publish and mark dispatched", func(t *testing.T) {
+		mockChannel := setupMockChannel(t)
+		mockChannel.On("QueueDeclare", "purchase_orders", true, false, false, false, amqp.Table(nil)).
+			Return(amqp.Queue{Name: "purchase_orders"}, nil)
+
+		var published amqp.Publishing
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.Anything).
+			Run(func(args mock.Arguments) {
+				published = args.Get(4).(amqp.Publishing)
+			}).Return(nil)
+
+		payload := outboxPayload(t, cfg, order)
+		dbMock := setupMockDB(t)
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(outboxEventsQuery).
+			WithArgs(defaultOutboxBatchSize).
+			WillReturnRows(sqlmock.NewRows(outboxColumns).AddRow(1, "PO123", 0, payload))
+		dbMock.ExpectExec("UPDATE outbox SET attempts = attempts \\+ 1, dispatched_at = NOW\\(\\)").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectCommit()
+
+		dispatched, err := relayOnce(context.Background(), context.Background(), cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, dispatched)
+
+		assert.Equal(t, "application/json", published.ContentType)
+		assert.Equal(t, "corr-123", published.CorrelationId)
+		assert.Equal(t, "purchase_order.approved", published.Type)
+		assert.Equal(t, "dynaproc", published.AppId)
+		assert.Equal(t, int32(1), published.Headers["x-schema-version"])
+		assert.Equal(t, uint8(amqp.Persistent), published.DeliveryMode)
+		assert.False(t, published.Timestamp.IsZero())
+
+		var env messageEnvelope
+		assert.NoError(t, json.Unmarshal(published.Body, &env))
+		assert.Equal(t, published.MessageId, env.MessageID)
+		assert.NotEmpty(t, env.MessageID)
+		assert.Equal(t, "purchase_order.approved", env.Type)
+		assert.Equal(t, 1, env.SchemaVersion)
+		assert.Equal(t, messageSource{App: "dynaproc", Version: "1.2.3"}, env.Source)
+		assert.Equal(t, "corr-123", env.CorrelationID)
+
+		mockChannel.AssertExpectations(t)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	// Test case 2: A failed publish is retried later and holds back the order's later rows
+	t.Run("Publish failure schedules retry", func(t *testing.T) {
+		mockChannel := setupMockChannel(t)
+		mockChannel.On("QueueDeclare", "purchase_orders", true, false, false, false, amqp.Table(nil)).
+			Return(amqp.Queue{Name: "purchase_orders"}, nil)
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+			return msg.CorrelationId == "corr-123"
+		})).Return(errors.New("channel closed")).Once()
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+			return msg.CorrelationId == "corr-456"
+		})).Return(nil).Once()
+
+		other := order
+		other.ID, other.CorrelationID = "PO456", "corr-456"
+		dbMock := setupMockDB(t)
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(outboxEventsQuery).
+			WillReturnRows(sqlmock.NewRows(outboxColumns).
+				AddRow(1, "PO123", 2, outboxPayload(t, cfg, order)).
+				AddRow(2, "PO123", 0, outboxPayload(t, cfg, order)).
+				AddRow(3, "PO456", 0, outboxPayload(t, cfg, other)))
+		dbMock.ExpectExec("UPDATE outbox SET attempts = attempts \\+ 1, next_attempt_at").
+			WithArgs(1, 4.0, "channel closed").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectExec("UPDATE outbox SET attempts = attempts \\+ 1, dispatched_at = NOW\\(\\)").
+			WithArgs(3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectCommit()
+
+		dispatched, err := relayOnce(context.Background(), context.Background(), cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, dispatched)
+
+		mockChannel.AssertExpectations(t)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	// Test case 3: Nothing is due
+	t.Run("Empty outbox", func(t *testing.T) {
+		dbMock := setupMockDB(t)
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(outboxEventsQuery).WillReturnRows(sqlmock.NewRows(outboxColumns))
+		dbMock.ExpectRollback()
+
+		dispatched, err := relayOnce(context.Background(), context.Background(), cfg)
+		assert.NoError(t, err)
+		assert.Zero(t, dispatched)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	cfg := OutboxConfig{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second}
+
+	assert.Equal(t, time.Second, outboxRetryDelay(cfg, 0))
+	assert.Equal(t, 2*time.Second, outboxRetryDelay(cfg, 1))
+	assert.Equal(t, 8*time.Second, outboxRetryDelay(cfg, 3))
+	assert.Equal(t, 10*time.Second, outboxRetryDelay(cfg, 4))
+	assert.Equal(t, defaultOutboxRetryDelay, outboxRetryDelay(OutboxConfig{}, 0))
+}
@@ -1,75 +1,324 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+const (
+	purchaseOrderQueue = "purchase_orders"
+	retryQueue         = "purchase_orders.retry"
+	deadLetterExchange = "purchase_orders.dlx"
+	deadLetterQueue    = "purchase_orders.dead"
+	parkingQueue       = "purchase_orders.parked"
+
+	retryCountHeader    = "x-retry-count"
+	failureReasonHeader = "x-failure-reason"
+	failedAtHeader      = "x-failed-at"
+
+	defaultRetryDelay = 30 * time.Second
+)
+
 type AMQPChannelInterface interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
 	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
 	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Qos(prefetchCount, prefetchSize int, global bool) error
 	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
 }
 
-var rabbitConn *amqp.Connection
+var rabbitConn AMQPConnectionInterface
 var rabbitChannel AMQPChannelInterface
 var osExit = os.Exit
 
-func InitRabbitMQ(cfg Config) {
-	var err error
-	rabbitConn, err = amqp.Dial(cfg.RabbitMQ.URL)
-	if err != nil {
-		log.Fatal(err)
+// declareTopology declares the work queue together with the retry queue, whose
+// messages expire back into the work queue after the retry delay, the
+// dead-letter exchange and queue for messages that cannot be processed, and
+// the parking queue for messages of a type or version this consumer does not
+// understand.
+func declareTopology(ch AMQPChannelInterface, cfg Config) error {
+	if _, err := ch.QueueDeclare(purchaseOrderQueue, true, false, false, false, nil); err != nil {
+		return err
 	}
 
-	rabbitChannel, err = rabbitConn.Channel()
+	retryDelay := cfg.RabbitMQ.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = defaultRetryDelay
+	}
+	_, err := ch.QueueDeclare(retryQueue, true, false, false, false, amqp.Table{
+		"x-message-ttl":             retryDelay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": purchaseOrderQueue,
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-}
 
-func PublishToQueue(order PurchaseOrder) error {
-	q, err := rabbitChannel.QueueDeclare("purchase_orders", true, false, false, false, nil)
-	if err != nil {
+	if err := ch.ExchangeDeclare(deadLetterExchange, "direct", true, false, false, false, nil); err != nil {
 		return err
 	}
+	if _, err := ch.QueueDeclare(deadLetterQueue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(deadLetterQueue, purchaseOrderQueue, deadLetterExchange, false, nil); err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(parkingQueue, true, false, false, false, nil)
+	return err
+}
+
+// ConsumeQueue processes deliveries on a pool of workers until ctx is
+// cancelled. When the delivery channel closes because the broker connection
+// dropped, it waits for the connection to be re-established and resumes
+// consuming. Messages already being handled when ctx is cancelled are given up
+// to cfg.DrainTimeout to finish.
+func ConsumeQueue(ctx context.Context, cfg Config) {
+	if err := declareTopology(currentChannel(), cfg); err != nil {
+		fatal("Failed to declare RabbitMQ topology", err)
+		return
+	}
+
+	workCtx, cancel := drainContext(ctx, cfg.DrainTimeout)
+	defer cancel()
+	defer health.SetConsumerActive(false)
+
+	for {
+		ch, generation := rabbitSession()
+		msgs, err := startConsuming(ch, cfg)
+		if err != nil {
+			slog.Error("Failed to start consuming", "queue", purchaseOrderQueue, "error", err)
+			if awaitRabbitMQReconnect(ctx, generation) {
+				continue
+			}
+			if ctx.Err() == nil {
+				osExit(1)
+			}
+			return
+		}
+
+		health.SetConsumerActive(true)
+		if !consumeDeliveries(ctx, workCtx, cfg, msgs) {
+			return
+		}
+		health.SetConsumerActive(false)
+
+		slog.Warn("Delivery channel closed, waiting for RabbitMQ to reconnect")
+		if !awaitRabbitMQReconnect(ctx, generation) {
+			return
+		}
+	}
+}
+
+// startConsuming limits the unacknowledged deliveries the broker sends to the
+// prefetch count and starts consuming the work queue.
+func startConsuming(ch AMQPChannelInterface, cfg Config) (<-chan amqp.Delivery, error) {
+	if err := ch.Qos(consumerPrefetch(cfg.RabbitMQ), 0, false); err != nil {
+		return nil, err
+	}
+	return ch.Consume(purchaseOrderQueue, "", false, false, false, false, nil)
+}
 
-	body, _ := json.Marshal(order)
-	return rabbitChannel.Publish("", q.Name, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        body,
+// consumeDeliveries hands deliveries to the worker pool until ctx is
+// cancelled, returning false, or the delivery channel closes, returning true.
+// Either way it returns only once the workers are done. While the Dynamics
+// circuit breaker is open it stops taking deliveries instead of failing each
+// of them.
+func consumeDeliveries(ctx, workCtx context.Context, cfg Config, msgs <-chan amqp.Delivery) bool {
+	pool := newDeliveryPool(ctx, cfg.RabbitMQ, func(msg amqp.Delivery) {
+		handleDelivery(workCtx, cfg, msg)
 	})
+	defer pool.close()
+
+	for {
+		if err := dynamicsBreaker.Wait(ctx); err != nil {
+			slog.Info("Stopping queue consumer")
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping queue consumer")
+			return false
+		case msg, ok := <-msgs:
+			if !ok {
+				return true
+			}
+			pool.dispatch(msg)
+		}
+	}
 }
 
-func ConsumeQueue(cfg Config) {
-	q, err := rabbitChannel.QueueDeclare("purchase_orders", true, false, false, false, nil)
+func handleDelivery(ctx context.Context, cfg Config, msg amqp.Delivery) {
+	consumerInFlight.Inc()
+	defer consumerInFlight.Dec()
+
+	po, env, err := decodeMessage(msg)
+	if errors.Is(err, errUnsupportedMessage) {
+		logger := slog.With("message_id", msg.MessageId, "correlation_id", msg.CorrelationId)
+		logger.Warn("Unsupported message, parking", "type", env.Type, "schema_version", env.SchemaVersion)
+		ordersFailed.WithLabelValues("consume", failureUnsupported, unknownVendor).Inc()
+		settleDelivery(logger, msg, park(ctx, cfg, msg, err.Error()))
+		return
+	}
 	if err != nil {
-		log.Print(err)
-		osExit(1)
+		logger := slog.With("message_id", msg.MessageId, "correlation_id", msg.CorrelationId)
+		logger.Error("Failed to parse message, dead-lettering", "error", err)
+		ordersFailed.WithLabelValues("consume", failureParse, unknownVendor).Inc()
+		settleDelivery(logger, msg, deadLetter(ctx, cfg, msg, fmt.Sprintf("unparseable message: %v", err)))
 		return
 	}
 
-	msgs, err := rabbitChannel.Consume(q.Name, "", true, false, false, false, nil)
-	if err != nil {
-		log.Print(err)
-		osExit(1)
+	// messages published before correlation IDs existed get a fresh one
+	po.CorrelationID = env.CorrelationID
+	if po.CorrelationID == "" {
+		po.CorrelationID = newRandomID()
+	}
+	po.MessageID = env.MessageID
+	logger := orderLogger(po)
+	ordersConsumed.WithLabelValues(po.VendorID).Inc()
+
+	err = SyncToDynamics(ctx, cfg, po)
+	if errors.Is(err, errAlreadyProcessed) {
+		logger.Info("Message already processed, skipping", "message_id", po.MessageID)
+		messagesDuplicate.Inc()
+		settleDelivery(logger, msg, nil)
+		return
+	}
+	if errors.Is(err, errStaleEvent) {
+		logger.Info("Event overtaken by a newer change, skipping", "version", po.Version)
+		settleDelivery(logger, msg, nil)
 		return
 	}
+	if err == nil {
+		ordersSynced.WithLabelValues(po.VendorID).Inc()
+		logger.Info("Synced order to Dynamics")
+		settleDelivery(logger, msg, nil)
+		return
+	}
+	recordFailure("sync", po.VendorID, err)
 
-	for msg := range msgs {
-		var po PurchaseOrder
-		if err := json.Unmarshal(msg.Body, &po); err != nil {
-			log.Printf("Failed to parse message: %v", err)
-			continue
-		}
+	var conflict *DynamicsConflictError
+	if errors.As(err, &conflict) {
+		logger.Warn("Order was changed in Dynamics, held for resolution", "dynamics_id", conflict.DynamicsID, "error", err)
+		ReportErrorToGlitchTip(cfg, po, err)
+		settleDelivery(logger, msg, nil)
+		return
+	}
 
-		err := SyncToDynamics(cfg, po)
-		if err != nil {
-			log.Printf("Sync failed: %v", err)
-			ReportErrorToGlitchTip(cfg, po.ID, err)
+	if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		logger.Warn("Sync interrupted by shutdown, requeueing", "error", err)
+		settleDelivery(logger, msg, err)
+		return
+	}
+
+	if errors.Is(err, errCircuitOpen) {
+		logger.Warn("Dynamics circuit breaker is open, requeueing", "error", err)
+		settleDelivery(logger, msg, err)
+		return
+	}
+
+	retries := retryCount(msg)
+	if retries < cfg.RabbitMQ.MaxRetries {
+		logger.Warn("Sync failed, retrying", "attempt", retries+1, "max_attempts", cfg.RabbitMQ.MaxRetries+1, "error", err)
+		settleDelivery(logger, msg, scheduleRetry(ctx, cfg, msg, retries+1, err))
+		return
+	}
+
+	logger.Error("Sync failed, dead-lettering", "attempts", retries+1, "error", err)
+	ReportErrorToGlitchTip(cfg, po, err)
+	settleDelivery(logger, msg, deadLetter(ctx, cfg, msg, err.Error()))
+}
+
+// settleDelivery acks the delivery once it has been handed off, or requeues it
+// when forwarding to the retry or dead-letter queue failed so it is not lost.
+func settleDelivery(logger *slog.Logger, msg amqp.Delivery, forwardErr error) {
+	if forwardErr != nil {
+		logger.Warn("Failed to forward message, requeueing", "error", forwardErr)
+		if err := msg.Nack(false, true); err != nil {
+			logger.Error("Failed to nack message", "error", err)
 		}
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		logger.Error("Failed to ack message", "error", err)
+	}
+}
+
+func scheduleRetry(ctx context.Context, cfg Config, msg amqp.Delivery, attempt int, syncErr error) error {
+	headers := copyHeaders(msg.Headers)
+	headers[retryCountHeader] = int32(attempt)
+	headers[failureReasonHeader] = syncErr.Error()
+
+	return publish(ctx, cfg, "", retryQueue, forwardedPublishing(msg, headers))
+}
+
+func deadLetter(ctx context.Context, cfg Config, msg amqp.Delivery, reason string) error {
+	headers := copyHeaders(msg.Headers)
+	headers[retryCountHeader] = int32(retryCount(msg))
+	headers[failureReasonHeader] = reason
+	headers[failedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+
+	return publish(ctx, cfg, deadLetterExchange, purchaseOrderQueue, forwardedPublishing(msg, headers))
+}
+
+// park moves a message this consumer cannot interpret to the parking queue,
+// untouched, so it can be replayed once a consumer that understands it runs.
+func park(ctx context.Context, cfg Config, msg amqp.Delivery, reason string) error {
+	headers := copyHeaders(msg.Headers)
+	headers[failureReasonHeader] = reason
+	headers[failedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+
+	return publish(ctx, cfg, "", parkingQueue, forwardedPublishing(msg, headers))
+}
+
+// forwardedPublishing republishes msg with new headers, keeping its body and
+// envelope properties.
+func forwardedPublishing(msg amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     msg.MessageId,
+		CorrelationId: msg.CorrelationId,
+		Type:          msg.Type,
+		Timestamp:     msg.Timestamp,
+		AppId:         msg.AppId,
+		Headers:       headers,
+		Body:          msg.Body,
+	}
+}
+
+func retryCount(msg amqp.Delivery) int {
+	switch v := msg.Headers[retryCountHeader].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for k, v := range headers {
+		copied[k] = v
 	}
+	return copied
 }
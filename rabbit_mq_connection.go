@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultReconnectDelay    = time.Second
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+type AMQPConnectionInterface interface {
+	Channel() (AMQPChannelInterface, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// amqpConnection adapts *amqp.Connection so Channel returns the interface
+// the rest of the package works with.
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (AMQPChannelInterface, error) {
+	return c.Connection.Channel()
+}
+
+var dialRabbitMQ = func(url string) (AMQPConnectionInterface, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// rabbitMu guards the connection and channel, which are swapped by
+// watchRabbitMQ whenever the broker connection is re-established.
+// rabbitReconnected is closed and replaced after every reconnect; it stays nil
+// when the connection is not managed by InitRabbitMQ.
+var (
+	rabbitMu          sync.RWMutex
+	rabbitGeneration  uint64
+	rabbitReconnected chan struct{}
+)
+
+// InitRabbitMQ connects to the broker, retrying with backoff until it succeeds,
+// and keeps the connection alive in the background until ctx is cancelled.
+func InitRabbitMQ(ctx context.Context, cfg Config) {
+	conn, ch, err := connectRabbitMQ(ctx, cfg)
+	if err != nil {
+		fatal("Failed to connect to RabbitMQ", err)
+		return
+	}
+
+	rabbitMu.Lock()
+	rabbitConn = conn
+	rabbitChannel = ch
+	rabbitReconnected = make(chan struct{})
+	rabbitMu.Unlock()
+
+	go watchRabbitMQ(ctx, cfg, conn, ch)
+}
+
+// CloseRabbitMQ closes the channel before the connection so the broker
+// requeues any deliveries this process has not acknowledged.
+func CloseRabbitMQ() {
+	rabbitMu.RLock()
+	conn, ch := rabbitConn, rabbitChannel
+	rabbitMu.RUnlock()
+
+	if err := ch.Close(); err != nil {
+		slog.Error("Failed to close RabbitMQ channel", "error", err)
+	}
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			slog.Error("Failed to close RabbitMQ connection", "error", err)
+		}
+	}
+}
+
+func currentChannel() AMQPChannelInterface {
+	ch, _ := rabbitSession()
+	return ch
+}
+
+// rabbitSession returns the current channel together with the generation it
+// belongs to, for use with awaitRabbitMQReconnect.
+func rabbitSession() (AMQPChannelInterface, uint64) {
+	rabbitMu.RLock()
+	defer rabbitMu.RUnlock()
+	return rabbitChannel, rabbitGeneration
+}
+
+// awaitRabbitMQReconnect blocks until a connection newer than generation is
+// available. It returns false if ctx is cancelled or the connection is not
+// managed, in which case there is nothing to wait for.
+func awaitRabbitMQReconnect(ctx context.Context, generation uint64) bool {
+	for {
+		rabbitMu.RLock()
+		current, reconnected := rabbitGeneration, rabbitReconnected
+		rabbitMu.RUnlock()
+
+		if reconnected == nil {
+			return false
+		}
+		if current > generation {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-reconnected:
+		}
+	}
+}
+
+func watchRabbitMQ(ctx context.Context, cfg Config, conn AMQPConnectionInterface, ch AMQPChannelInterface) {
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-connClosed:
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("RabbitMQ connection closed", "error", err)
+		case err := <-chClosed:
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("RabbitMQ channel closed", "error", err)
+			conn.Close()
+		}
+
+		var err error
+		conn, ch, err = connectRabbitMQ(ctx, cfg)
+		if err != nil {
+			return
+		}
+
+		rabbitMu.Lock()
+		rabbitConn = conn
+		rabbitChannel = ch
+		rabbitGeneration++
+		close(rabbitReconnected)
+		rabbitReconnected = make(chan struct{})
+		rabbitMu.Unlock()
+
+		slog.Info("Reconnected to RabbitMQ")
+	}
+}
+
+// connectRabbitMQ dials the broker, opens a channel and declares the topology,
+// backing off exponentially with jitter between failed attempts.
+func connectRabbitMQ(ctx context.Context, cfg Config) (AMQPConnectionInterface, AMQPChannelInterface, error) {
+	for attempt := 0; ; attempt++ {
+		conn, ch, err := openRabbitMQ(cfg)
+		if err == nil {
+			return conn, ch, nil
+		}
+
+		delay := reconnectDelay(cfg.RabbitMQ, attempt)
+		slog.Warn("Failed to connect to RabbitMQ, retrying", "attempt", attempt+1, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func openRabbitMQ(cfg Config) (AMQPConnectionInterface, AMQPChannelInterface, error) {
+	conn, err := dialRabbitMQ(cfg.RabbitMQ.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := declareTopology(ch, cfg); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, ch, nil
+}
+
+// reconnectDelay doubles the delay for every failed attempt up to the
+// configured maximum, then picks a random point in its upper half so replicas
+// do not reconnect in lockstep after a broker restart.
+func reconnectDelay(cfg RabbitMQConfig, attempt int) time.Duration {
+	base := cfg.ReconnectDelay
+	if base <= 0 {
+		base = defaultReconnectDelay
+	}
+	max := cfg.MaxReconnectDelay
+	if max <= 0 {
+		max = defaultMaxReconnectDelay
+	}
+
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+// confirmBufferSize bounds how many confirmations or returns may be pending
+// unread. streadway/amqp blocks the connection if these channels fill up, and
+// stale confirmations accumulate only when a publish times out.
+const confirmBufferSize = 64
+
+var (
+	errPublishNacked   = errors.New("rabbitmq: publish was nacked by the broker")
+	errPublishTimeout  = errors.New("rabbitmq: timed out waiting for publish confirmation")
+	errConfirmsClosed  = errors.New("rabbitmq: channel closed before publish was confirmed")
+	errMessageReturned = errors.New("rabbitmq: message returned as unroutable")
+)
+
+// confirmPublisher publishes on a channel in confirm mode and waits for the
+// broker to ack each message. Publishes are serialized so every caller can
+// match its own confirmation by delivery tag.
+type confirmPublisher struct {
+	mu       sync.Mutex
+	ch       AMQPChannelInterface
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	lastTag  uint64
+}
+
+var rabbitPublisher *confirmPublisher
+
+func newConfirmPublisher(ch AMQPChannelInterface) (*confirmPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	return &confirmPublisher{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, confirmBufferSize)),
+	}, nil
+}
+
+// currentPublisher returns the confirm publisher for the current channel,
+// putting the channel into confirm mode the first time it is used.
+func currentPublisher() (*confirmPublisher, error) {
+	rabbitMu.Lock()
+	defer rabbitMu.Unlock()
+
+	if rabbitPublisher != nil && rabbitPublisher.ch == rabbitChannel {
+		return rabbitPublisher, nil
+	}
+
+	publisher, err := newConfirmPublisher(rabbitChannel)
+	if err != nil {
+		return nil, err
+	}
+	rabbitPublisher = publisher
+	return publisher, nil
+}
+
+// publish sends msg as a mandatory message and waits for the broker to
+// confirm it, so a dropped or unroutable message surfaces as an error.
+func publish(ctx context.Context, cfg Config, exchange, key string, msg amqp.Publishing) error {
+	publisher, err := currentPublisher()
+	if err != nil {
+		return err
+	}
+
+	timeout := cfg.RabbitMQ.ConfirmTimeout
+	if timeout <= 0 {
+		timeout = defaultConfirmTimeout
+	}
+	return publisher.publish(ctx, exchange, key, msg, timeout)
+}
+
+func (p *confirmPublisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing, timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Returns carry no delivery tag, so the message ID is what ties a
+	// basic.return to the message it belongs to.
+	if msg.MessageId == "" {
+		msg.MessageId = newRandomID()
+	}
+
+	if err := p.ch.Publish(exchange, key, true, false, msg); err != nil {
+		return err
+	}
+	p.lastTag++
+	tag := p.lastTag
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var returned *amqp.Return
+	for {
+		select {
+		case r := <-p.returns:
+			if r.MessageId == msg.MessageId {
+				returned = &r
+			}
+		case c, ok := <-p.confirms:
+			if !ok {
+				return errConfirmsClosed
+			}
+			if c.DeliveryTag < tag {
+				// confirmation for an earlier publish that timed out
+				continue
+			}
+			if !c.Ack {
+				return errPublishNacked
+			}
+			if returned == nil {
+				// the broker sends basic.return before the ack, but both
+				// may already be buffered, so drain returns before accepting
+				returned = p.drainReturns(msg.MessageId)
+			}
+			if returned != nil {
+				return fmt.Errorf("%w: %d %s", errMessageReturned, returned.ReplyCode, returned.ReplyText)
+			}
+			return nil
+		case <-timer.C:
+			return errPublishTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *confirmPublisher) drainReturns(messageID string) *amqp.Return {
+	var returned *amqp.Return
+	for {
+		select {
+		case r := <-p.returns:
+			if r.MessageId == messageID {
+				returned = &r
+			}
+		default:
+			return returned
+		}
+	}
+}
+
+func newRandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestPublisher(mockChannel *MockAMQPChannel) *confirmPublisher {
+	return &confirmPublisher{
+		ch:       mockChannel,
+		confirms: make(chan amqp.Confirmation, confirmBufferSize),
+		returns:  make(chan amqp.Return, confirmBufferSize),
+	}
+}
+
+func TestConfirmPublisher(t *testing.T) {
+	// Test case 1: Broker acks the message
+	t.Run("Ack", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		p := newTestPublisher(mockChannel)
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.Anything).Run(func(args mock.Arguments) {
+			p.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+		}).Return(nil)
+
+		err := p.publish(context.Background(), "", "purchase_orders", amqp.Publishing{}, time.Second)
+		assert.NoError(t, err)
+	})
+
+	// Test case 2: Broker nacks the message
+	t.Run("Nack", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		p := newTestPublisher(mockChannel)
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.Anything).Run(func(args mock.Arguments) {
+			p.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+		}).Return(nil)
+
+		err := p.publish(context.Background(), "", "purchase_orders", amqp.Publishing{}, time.Second)
+		assert.ErrorIs(t, err, errPublishNacked)
+	})
+
+	// Test case 3: Mandatory message cannot be routed
+	t.Run("Unroutable message is returned", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		p := newTestPublisher(mockChannel)
+		mockChannel.On("Publish", "", "missing_queue", true, false, mock.Anything).Run(func(args mock.Arguments) {
+			msg := args.Get(4).(amqp.Publishing)
+			p.returns <- amqp.Return{MessageId: msg.MessageId, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+			p.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+		}).Return(nil)
+
+		err := p.publish(context.Background(), "", "missing_queue", amqp.Publishing{}, time.Second)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "NO_ROUTE")
+	})
+
+	// Test case 4: No confirmation arrives in time
+	t.Run("Timeout", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		p := newTestPublisher(mockChannel)
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.Anything).Return(nil)
+
+		err := p.publish(context.Background(), "", "purchase_orders", amqp.Publishing{}, 10*time.Millisecond)
+		assert.ErrorIs(t, err, errPublishTimeout)
+	})
+
+	// Test case 5: Late confirmation of a timed-out publish is skipped
+	t.Run("Skip stale confirmation", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		p := newTestPublisher(mockChannel)
+		p.lastTag = 1
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.Anything).Run(func(args mock.Arguments) {
+			p.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+			p.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+		}).Return(nil)
+
+		err := p.publish(context.Background(), "", "purchase_orders", amqp.Publishing{}, time.Second)
+		assert.NoError(t, err)
+	})
+
+	// Test case 6: Channel closes while waiting
+	t.Run("Channel closed", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		p := newTestPublisher(mockChannel)
+		mockChannel.On("Publish", "", "purchase_orders", true, false, mock.Anything).Run(func(args mock.Arguments) {
+			close(p.confirms)
+		}).Return(nil)
+
+		err := p.publish(context.Background(), "", "purchase_orders", amqp.Publishing{}, time.Second)
+		assert.ErrorIs(t, err, errConfirmsClosed)
+	})
+}
+
+func TestCurrentPublisher(t *testing.T) {
+	// Test case 1: Channel is put into confirm mode once
+	t.Run("Enable confirm mode", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		originalChannel, originalPublisher := rabbitChannel, rabbitPublisher
+		defer func() { rabbitChannel, rabbitPublisher = originalChannel, originalPublisher }()
+		rabbitChannel = mockChannel
+
+		mockChannel.On("Confirm", false).Return(nil).Once()
+
+		first, err := currentPublisher()
+		assert.NoError(t, err)
+		second, err := currentPublisher()
+		assert.NoError(t, err)
+
+		assert.Same(t, first, second)
+		assert.NotNil(t, mockChannel.confirms)
+		assert.NotNil(t, mockChannel.returns)
+		mockChannel.AssertExpectations(t)
+	})
+
+	// Test case 2: Confirm mode is not supported
+	t.Run("Confirm error", func(t *testing.T) {
+		mockChannel := new(MockAMQPChannel)
+		originalChannel, originalPublisher := rabbitChannel, rabbitPublisher
+		defer func() { rabbitChannel, rabbitPublisher = originalChannel, originalPublisher }()
+		rabbitChannel = mockChannel
+
+		mockChannel.On("Confirm", false).Return(errors.New("confirm not supported"))
+
+		_, err := currentPublisher()
+		assert.Error(t, err)
+	})
+}
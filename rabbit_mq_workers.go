@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+const defaultConsumerWorkers = 1
+
+// consumerWorkers returns how many deliveries are handled concurrently.
+func consumerWorkers(cfg RabbitMQConfig) int {
+	if cfg.Workers <= 0 {
+		return defaultConsumerWorkers
+	}
+	return cfg.Workers
+}
+
+// consumerPrefetch returns how many unacknowledged deliveries the broker may
+// send ahead, by default two per worker so none of them waits on the network.
+func consumerPrefetch(cfg RabbitMQConfig) int {
+	if cfg.Prefetch <= 0 {
+		return 2 * consumerWorkers(cfg)
+	}
+	return cfg.Prefetch
+}
+
+// deliveryPool handles deliveries on a fixed set of workers. Deliveries for
+// the same purchase order always go to the same worker, so updates to one
+// order are handled in the order they were delivered while different orders
+// are synced concurrently.
+type deliveryPool struct {
+	queues []chan amqp.Delivery
+	wg     sync.WaitGroup
+}
+
+// newDeliveryPool starts the workers, which pass each delivery to handle.
+// Each worker's queue holds a full prefetch window, so dispatching never
+// blocks behind a slow order. Once ctx is cancelled, deliveries that have not
+// been started are requeued rather than handled.
+func newDeliveryPool(ctx context.Context, cfg RabbitMQConfig, handle func(amqp.Delivery)) *deliveryPool {
+	pool := &deliveryPool{queues: make([]chan amqp.Delivery, consumerWorkers(cfg))}
+	for i := range pool.queues {
+		queue := make(chan amqp.Delivery, consumerPrefetch(cfg))
+		pool.queues[i] = queue
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for msg := range queue {
+				if ctx.Err() != nil {
+					requeueUnstarted(msg)
+					continue
+				}
+				handle(msg)
+			}
+		}()
+	}
+	return pool
+}
+
+func (p *deliveryPool) dispatch(msg amqp.Delivery) {
+	p.queues[deliveryShard(msg, len(p.queues))] <- msg
+}
+
+// close waits for the workers to finish every delivery already dispatched.
+func (p *deliveryPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// deliveryShard picks the worker for msg by hashing its ordering key.
+func deliveryShard(msg amqp.Delivery, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(orderingKey(msg)))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// orderingKey is the purchase order ID of the message, or its message ID when
+// the body cannot be parsed; such messages are only dead-lettered or parked.
+func orderingKey(msg amqp.Delivery) string {
+	var body struct {
+		ID   string `json:"id"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err == nil {
+		if body.Data.ID != "" {
+			return body.Data.ID
+		}
+		if body.ID != "" {
+			return body.ID
+		}
+	}
+	return msg.MessageId
+}
+
+func requeueUnstarted(msg amqp.Delivery) {
+	if err := msg.Nack(false, true); err != nil {
+		slog.Error("Failed to requeue message on shutdown", "message_id", msg.MessageId, "correlation_id", msg.CorrelationId, "error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func orderDelivery(tag uint64, poID string) amqp.Delivery {
+	return amqp.Delivery{DeliveryTag: tag, Body: []byte(fmt.Sprintf(`{"id":%q}`, poID))}
+}
+
+func TestConsumerPoolSize(t *testing.T) {
+	assert.Equal(t, 1, consumerWorkers(RabbitMQConfig{}))
+	assert.Equal(t, 2, consumerPrefetch(RabbitMQConfig{}))
+	assert.Equal(t, 4, consumerWorkers(RabbitMQConfig{Workers: 4}))
+	assert.Equal(t, 8, consumerPrefetch(RabbitMQConfig{Workers: 4}))
+	assert.Equal(t, 20, consumerPrefetch(RabbitMQConfig{Workers: 4, Prefetch: 20}))
+}
+
+func TestOrderingKey(t *testing.T) {
+	assert.Equal(t, "PO123", orderingKey(orderDelivery(1, "PO123")))
+	env, _ := newOrderEnvelope(Config{}, eventOrderApproved, PurchaseOrder{ID: "PO456"})
+	assert.Equal(t, "PO456", orderingKey(envelopeDelivery(t, env)))
+	assert.Equal(t, "msg-1", orderingKey(amqp.Delivery{MessageId: "msg-1", Body: []byte("not json")}))
+
+	// the same order always lands on the same worker
+	shard := deliveryShard(orderDelivery(1, "PO123"), 8)
+	for tag := uint64(2); tag < 10; tag++ {
+		assert.Equal(t, shard, deliveryShard(orderDelivery(tag, "PO123"), 8))
+	}
+}
+
+func TestDeliveryPool(t *testing.T) {
+	// Test case 1: Different orders are handled concurrently
+	t.Run("Concurrent orders", func(t *testing.T) {
+		var started sync.WaitGroup
+		started.Add(2)
+		release := make(chan struct{})
+
+		// pick two orders that hash to different workers
+		first, second := "PO1", ""
+		for i := 2; second == ""; i++ {
+			if id := fmt.Sprintf("PO%d", i); deliveryShard(orderDelivery(0, id), 2) != deliveryShard(orderDelivery(0, first), 2) {
+				second = id
+			}
+		}
+
+		pool := newDeliveryPool(context.Background(), RabbitMQConfig{Workers: 2}, func(msg amqp.Delivery) {
+			started.Done()
+			<-release
+		})
+		pool.dispatch(orderDelivery(1, first))
+		pool.dispatch(orderDelivery(2, second))
+
+		bothStarted := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(bothStarted)
+		}()
+		select {
+		case <-bothStarted:
+		case <-time.After(time.Second):
+			t.Fatal("orders on different workers were not handled concurrently")
+		}
+		close(release)
+		pool.close()
+	})
+
+	// Test case 2: Deliveries for the same order are handled serially and in order
+	t.Run("Per-order ordering", func(t *testing.T) {
+		var mu sync.Mutex
+		var handled []uint64
+		inFlight := map[string]bool{}
+
+		pool := newDeliveryPool(context.Background(), RabbitMQConfig{Workers: 4, Prefetch: 50}, func(msg amqp.Delivery) {
+			key := orderingKey(msg)
+			mu.Lock()
+			assert.False(t, inFlight[key], "two deliveries for %s handled at once", key)
+			inFlight[key] = true
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			inFlight[key] = false
+			if key == "PO123" {
+				handled = append(handled, msg.DeliveryTag)
+			}
+			mu.Unlock()
+		})
+
+		for tag := uint64(1); tag <= 30; tag++ {
+			poID := "PO123"
+			if tag%3 == 0 {
+				poID = fmt.Sprintf("PO%d", 1000+tag)
+			}
+			pool.dispatch(orderDelivery(tag, poID))
+		}
+		pool.close()
+
+		var want []uint64
+		for tag := uint64(1); tag <= 30; tag++ {
+			if tag%3 != 0 {
+				want = append(want, tag)
+			}
+		}
+		assert.Equal(t, want, handled)
+	})
+
+	// Test case 3: Deliveries not yet started when shutting down are requeued
+	t.Run("Requeue on shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		var handled []uint64
+		pool := newDeliveryPool(ctx, RabbitMQConfig{Workers: 1}, func(msg amqp.Delivery) {
+			handled = append(handled, msg.DeliveryTag)
+			close(started)
+			<-release
+		})
+
+		acknowledger := new(MockAcknowledger)
+		acknowledger.On("Nack", uint64(2), false, true).Return(nil)
+
+		pool.dispatch(orderDelivery(1, "PO1"))
+		<-started
+		queued := orderDelivery(2, "PO2")
+		queued.Acknowledger = acknowledger
+		pool.dispatch(queued)
+
+		cancel()
+		close(release)
+		pool.close()
+
+		assert.Equal(t, []uint64{1}, handled)
+		acknowledger.AssertExpectations(t)
+	})
+}
+
+func TestConsumeQueuePrefetch(t *testing.T) {
+	mockChannel := setupMockChannel(t)
+	expectTopology(mockChannel, defaultRetryDelay)
+
+	acknowledger := new(MockAcknowledger)
+	acknowledger.On("Ack", uint64(1), false).Return(nil)
+	mockChannel.On("Publish", "purchase_orders.dlx", "purchase_orders", true, false, mock.Anything).Return(nil)
+
+	cfg := Config{RabbitMQ: RabbitMQConfig{Workers: 3, Prefetch: 12}}
+	runConsumer(t, mockChannel, cfg, amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: []byte("not json")})
+
+	mockChannel.AssertCalled(t, "Qos", 12, 0, false)
+	acknowledger.AssertExpectations(t)
+}
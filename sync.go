@@ -2,33 +2,603 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
-func SyncToDynamics(cfg Config, po PurchaseOrder) error {
-	payload := map[string]interface{}{
+// DynamicsAPIError is returned when Dynamics answers with a non-2xx status.
+type DynamicsAPIError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *DynamicsAPIError) Error() string {
+	return fmt.Sprintf("dynamics API Error: %s", e.Status)
+}
+
+// DynamicsConflictError is returned when Dynamics rejects an update with 412
+// Precondition Failed because the order was changed there since it was last
+// synced. CurrentETag is empty when the current version could not be read,
+// and CurrentLines, the ETags of the lines Dynamics has by line number, is nil.
+type DynamicsConflictError struct {
+	DynamicsID   string
+	ExpectedETag string
+	CurrentETag  string
+	CurrentLines map[int]string
+}
+
+func (e *DynamicsConflictError) Error() string {
+	return fmt.Sprintf("dynamics conflict: order %s was changed in Dynamics since it was last synced", e.DynamicsID)
+}
+
+// dynamicsRecord identifies the order header in Dynamics by its key and the
+// ETag of the version last written or read. Lines holds the ETags of the
+// order's lines by line number; it is nil when they are not known.
+type dynamicsRecord struct {
+	Key   string
+	ETag  string
+	Lines map[int]string
+}
+
+const defaultCancelAction = "Microsoft.Dynamics.DataEntities.CancelPurchaseOrder"
+
+var (
+	// errAlreadyProcessed is returned by SyncToDynamics for a message the
+	// ledger shows was synced before.
+	errAlreadyProcessed = errors.New("message already processed")
+
+	// errStaleEvent is returned by SyncToDynamics for an event that was
+	// overtaken by a newer change to the order.
+	errStaleEvent = errors.New("event superseded by a newer change")
+
+	// errMissingETag is returned instead of updating an order in Dynamics
+	// whose version is unknown, which would overwrite any edits made there.
+	errMissingETag = errors.New("no ETag known for the order in Dynamics")
+)
+
+// SyncToDynamics creates, updates or cancels the order in Dynamics according
+// to po.Action and records the outcome. It returns errAlreadyProcessed when
+// the message ledger shows the order's message was synced before,
+// errStaleEvent when a newer change to the order has been made since the
+// event was published, and errCircuitOpen without touching the order while the
+// Dynamics circuit breaker is open. A *DynamicsConflictError is recorded in
+// sync_conflicts for resolution instead of marking the order failed; when it
+// cannot be recorded the order is marked failed with a retryable error.
+func SyncToDynamics(ctx context.Context, cfg Config, po PurchaseOrder) error {
+	if po.MessageID != "" {
+		processed, err := IsMessageProcessed(ctx, po.MessageID)
+		if err != nil {
+			return err
+		}
+		if processed {
+			return errAlreadyProcessed
+		}
+	}
+
+	if err := dynamicsBreaker.Allow(); err != nil {
+		return err
+	}
+	stored, err := MarkOrderSyncing(ctx, po.ID, po.Version)
+	if errors.Is(err, errStaleEvent) {
+		dynamicsBreaker.Release()
+		return err
+	}
+	if err != nil {
+		dynamicsBreaker.Record(err)
+		return err
+	}
+	orderLogger(po).Debug("Posting order to Dynamics", "action", po.Action)
+
+	record, err := postToDynamics(ctx, cfg, po, stored)
+	var conflict *DynamicsConflictError
+	if errors.As(err, &conflict) {
+		recordErr := RecordSyncConflict(ctx, po, conflict)
+		if recordErr == nil {
+			return err
+		}
+		// an unrecorded conflict must be retried rather than acknowledged
+		err = fmt.Errorf("record sync conflict: %w", recordErr)
+	}
+	if err != nil {
+		if markErr := MarkOrderFailed(ctx, po.ID, record, err); markErr != nil {
+			orderLogger(po).Error("Failed to mark order as failed", "error", markErr)
+		}
+		return err
+	}
+
+	if err := MarkOrderSynced(ctx, po.ID, record); err != nil {
+		return err
+	}
+	if po.MessageID != "" {
+		// the Dynamics lookup still prevents a duplicate if this is lost
+		if err := RecordProcessedMessage(ctx, po.MessageID, po.ID); err != nil {
+			orderLogger(po).Warn("Failed to record processed message", "error", err)
+		}
+	}
+	return nil
+}
+
+// postToDynamics writes the order to Dynamics and returns the header record.
+// The record stored by an earlier sync, if any, is passed as stored. When the
+// header was written but a later step failed, the header record is returned
+// along with the error.
+func postToDynamics(ctx context.Context, cfg Config, po PurchaseOrder, stored dynamicsRecord) (dynamicsRecord, error) {
+	start := time.Now()
+	var record dynamicsRecord
+	var err error
+	if po.Action == SyncActionCancel {
+		record, err = cancelDynamicsOrder(ctx, cfg, po, stored)
+	} else {
+		record, err = upsertDynamicsOrder(ctx, cfg, po, stored)
+	}
+	dynamicsBreaker.Record(err)
+	if err != nil {
+		syncDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		health.RecordDynamicsFailure()
+		return record, err
+	}
+	syncDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+	health.RecordDynamicsSuccess()
+
+	return record, nil
+}
+
+// upsertDynamicsOrder writes the order header and then each of its lines, which
+// reference the header by purchase order number. Unless the header key is
+// already known, Dynamics is searched for a header with the purchase order
+// number first, so a message that is processed twice never creates a second
+// order: an existing header and its existing lines are updated with PATCH,
+// missing lines are created and lines the order no longer has are deleted.
+//
+// The header is patched with If-Match set to its known ETag, so an order that
+// was edited in Dynamics since it was last synced is not overwritten; Dynamics
+// answers 412 and a *DynamicsConflictError is returned instead. An order
+// synced before ETags were stored has no version to compare with, so it is a
+// conflict as well rather than being patched against whatever Dynamics holds
+// now. When the write response carries no ETag, the header is read back for
+// it.
+//
+// Lines are held to the same rule. Before anything is written, the lines of a
+// synced order are compared with the ETags stored at its last sync, and a line
+// edited, added or removed in Dynamics since then is a conflict. Lines are
+// then patched and deleted with If-Match as well.
+func upsertDynamicsOrder(ctx context.Context, cfg Config, po PurchaseOrder, stored dynamicsRecord) (dynamicsRecord, error) {
+	record, err := resolveDynamicsOrder(ctx, cfg, po, stored)
+	if err != nil {
+		return dynamicsRecord{}, err
+	}
+	exists := record.Key != ""
+
+	var linesURL string
+	if exists || len(po.Lines) > 0 {
+		if linesURL, err = dynamicsLinesURL(cfg.Dynamics365); err != nil {
+			return dynamicsRecord{}, err
+		}
+	}
+	var existingLines []dynamicsEntity
+	if exists {
+		if existingLines, err = findDynamicsEntities(ctx, linesURL, po.ID); err != nil {
+			return dynamicsRecord{}, fmt.Errorf("look up lines: %w", err)
+		}
+		// a header found by number was written by us but never recorded, so
+		// there is nothing to compare it with; a recorded one without an ETag
+		// cannot be shown to be unchanged
+		if stored.Key != "" && (stored.ETag == "" || !sameLineETags(stored.Lines, existingLines)) {
+			return dynamicsRecord{}, dynamicsConflict(ctx, cfg, po, record)
+		}
+	}
+
+	if exists {
+		payload := dynamicsOrderPayload(po)
+		delete(payload, "PurchaseOrderNumber")
+		if record.ETag == "" {
+			return dynamicsRecord{}, fmt.Errorf("update order %s: %w", record.Key, errMissingETag)
+		}
+		header := http.Header{"Prefer": {"return=representation"}, "If-Match": {record.ETag}}
+		resp, err := sendDynamicsEntity(ctx, "PATCH", dynamicsEntityURL(cfg.Dynamics365.APIURL, record.Key), header, payload)
+		if preconditionFailed(err) {
+			return dynamicsRecord{}, dynamicsConflict(ctx, cfg, po, record)
+		}
+		if err != nil {
+			return dynamicsRecord{}, err
+		}
+		record.ETag = readDynamicsRecord(resp).ETag
+		resp.Body.Close()
+	} else {
+		resp, err := sendDynamicsEntity(ctx, "POST", cfg.Dynamics365.APIURL, http.Header{"Prefer": {"return=representation"}}, dynamicsOrderPayload(po))
+		if err != nil {
+			return dynamicsRecord{}, err
+		}
+		record = readDynamicsRecord(resp)
+		resp.Body.Close()
+	}
+	if record.ETag == "" {
+		if record.ETag, err = currentDynamicsETag(ctx, cfg, po); err != nil {
+			orderLogger(po).Warn("Failed to read the order's ETag from Dynamics", "error", err)
+		}
+	}
+
+	if len(po.Lines) == 0 && !exists {
+		return record, nil
+	}
+
+	// record.Lines follows the lines Dynamics holds as each one is written, so
+	// a failure part way through leaves the right ETags to be stored
+	record.Lines = make(map[int]string, len(existingLines))
+	lineKeys := make(map[int]string, len(existingLines))
+	for _, line := range existingLines {
+		record.Lines[line.LineNumber] = line.ETag
+		lineKeys[line.LineNumber] = line.lineKey()
+	}
+
+	for _, line := range po.Lines {
+		method, target, payload := "POST", linesURL, dynamicsLinePayload(po, line)
+		header := http.Header{"Prefer": {"return=representation"}}
+		if key, ok := lineKeys[line.LineNumber]; ok {
+			if record.Lines[line.LineNumber] == "" {
+				return record, fmt.Errorf("update line %d: %w", line.LineNumber, errMissingETag)
+			}
+			method, target = "PATCH", dynamicsEntityURL(linesURL, key)
+			header.Set("If-Match", record.Lines[line.LineNumber])
+			delete(payload, "PurchaseOrderNumber")
+			delete(payload, "LineNumber")
+			delete(lineKeys, line.LineNumber)
+		}
+		resp, err := sendDynamicsEntity(ctx, method, target, header, payload)
+		if preconditionFailed(err) {
+			return dynamicsRecord{}, dynamicsConflict(ctx, cfg, po, record)
+		}
+		if err != nil {
+			return record, fmt.Errorf("post line %d: %w", line.LineNumber, err)
+		}
+		record.Lines[line.LineNumber] = readDynamicsRecord(resp).ETag
+		resp.Body.Close()
+	}
+
+	for lineNumber, key := range lineKeys {
+		if record.Lines[lineNumber] == "" {
+			return record, fmt.Errorf("delete line %d: %w", lineNumber, errMissingETag)
+		}
+		resp, err := sendDynamicsEntity(ctx, "DELETE", dynamicsEntityURL(linesURL, key), http.Header{"If-Match": {record.Lines[lineNumber]}}, nil)
+		if preconditionFailed(err) {
+			return dynamicsRecord{}, dynamicsConflict(ctx, cfg, po, record)
+		}
+		if err != nil {
+			return record, fmt.Errorf("delete line %d: %w", lineNumber, err)
+		}
+		delete(record.Lines, lineNumber)
+		resp.Body.Close()
+	}
+
+	if hasEmptyETag(record.Lines) {
+		lines, err := currentDynamicsLines(ctx, cfg, po)
+		if err != nil {
+			orderLogger(po).Warn("Failed to read the order's line ETags from Dynamics", "error", err)
+			return record, nil
+		}
+		for lineNumber, etag := range record.Lines {
+			if etag == "" {
+				record.Lines[lineNumber] = lines[lineNumber]
+			}
+		}
+	}
+	return record, nil
+}
+
+func hasEmptyETag(etags map[int]string) bool {
+	for _, etag := range etags {
+		if etag == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sameLineETags reports whether the lines in Dynamics are exactly the ones
+// stored at the last sync, each still at the version written then.
+func sameLineETags(stored map[int]string, lines []dynamicsEntity) bool {
+	if len(stored) != len(lines) {
+		return false
+	}
+	for _, line := range lines {
+		if etag, ok := stored[line.LineNumber]; !ok || etag != line.ETag {
+			return false
+		}
+	}
+	return true
+}
+
+// preconditionFailed reports whether Dynamics rejected a write because the
+// If-Match ETag no longer matched.
+func preconditionFailed(err error) bool {
+	var apiErr *DynamicsAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// dynamicsConflict reads the current ETags of the header and its lines, so
+// whoever resolves the conflict can see the version they are deciding against,
+// and builds the conflict error. Failing to read them does not hide the
+// conflict.
+func dynamicsConflict(ctx context.Context, cfg Config, po PurchaseOrder, record dynamicsRecord) error {
+	conflict := &DynamicsConflictError{DynamicsID: record.Key, ExpectedETag: record.ETag}
+	etag, err := currentDynamicsETag(ctx, cfg, po)
+	if err != nil {
+		orderLogger(po).Warn("Failed to read the conflicting order from Dynamics", "error", err)
+	}
+	conflict.CurrentETag = etag
+	if conflict.CurrentLines, err = currentDynamicsLines(ctx, cfg, po); err != nil {
+		orderLogger(po).Warn("Failed to read the conflicting order's lines from Dynamics", "error", err)
+	}
+	return conflict
+}
+
+// currentDynamicsETag reads the ETag the order's header has in Dynamics now,
+// or returns an empty string when there is no such header.
+func currentDynamicsETag(ctx context.Context, cfg Config, po PurchaseOrder) (string, error) {
+	headers, err := findDynamicsEntities(ctx, cfg.Dynamics365.APIURL, po.ID)
+	if err != nil || len(headers) == 0 {
+		return "", err
+	}
+	return headers[0].ETag, nil
+}
+
+// currentDynamicsLines reads the ETags the order's lines have in Dynamics now,
+// by line number.
+func currentDynamicsLines(ctx context.Context, cfg Config, po PurchaseOrder) (map[int]string, error) {
+	linesURL, err := dynamicsLinesURL(cfg.Dynamics365)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := findDynamicsEntities(ctx, linesURL, po.ID)
+	if err != nil {
+		return nil, err
+	}
+	etags := make(map[int]string, len(lines))
+	for _, line := range lines {
+		etags[line.LineNumber] = line.ETag
+	}
+	return etags, nil
+}
+
+// cancelDynamicsOrder invokes the configured cancellation action on the order
+// header. An order that never reached Dynamics has nothing to cancel. The
+// action changes the header, so the returned record carries no ETag.
+func cancelDynamicsOrder(ctx context.Context, cfg Config, po PurchaseOrder, stored dynamicsRecord) (dynamicsRecord, error) {
+	record, err := resolveDynamicsOrder(ctx, cfg, po, stored)
+	if err != nil || record.Key == "" {
+		return dynamicsRecord{}, err
+	}
+
+	action := cfg.Dynamics365.CancelAction
+	if action == "" {
+		action = defaultCancelAction
+	}
+	resp, err := sendDynamicsEntity(ctx, "POST", dynamicsEntityURL(cfg.Dynamics365.APIURL, record.Key)+"/"+action, nil, map[string]interface{}{})
+	if err != nil {
+		return dynamicsRecord{}, fmt.Errorf("cancel order: %w", err)
+	}
+	resp.Body.Close()
+	return dynamicsRecord{Key: record.Key}, nil
+}
+
+// resolveDynamicsOrder returns the order's header in Dynamics, looking it up
+// by purchase order number unless its key is already known, or an empty
+// record when there is no such header.
+func resolveDynamicsOrder(ctx context.Context, cfg Config, po PurchaseOrder, stored dynamicsRecord) (dynamicsRecord, error) {
+	if stored.Key != "" {
+		return stored, nil
+	}
+
+	headers, err := findDynamicsEntities(ctx, cfg.Dynamics365.APIURL, po.ID)
+	if err != nil {
+		return dynamicsRecord{}, fmt.Errorf("look up order: %w", err)
+	}
+	if len(headers) == 0 {
+		return dynamicsRecord{}, nil
+	}
+	return dynamicsRecord{Key: headers[0].headerKey(), ETag: headers[0].ETag}, nil
+}
+
+func dynamicsOrderPayload(po PurchaseOrder) map[string]interface{} {
+	return map[string]interface{}{
 		"PurchaseOrderNumber": po.ID,
 		"VendorAccountNumber": po.VendorID,
-		"TotalAmount":         po.Amount,
+		"TotalAmount":         moneyJSON(po.Amount, po.Currency),
 		"Currency":            po.Currency,
 	}
+}
 
-	jsonPayload, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", cfg.Dynamics365.APIURL, bytes.NewBuffer(jsonPayload))
-	req.Header.Set("Content-Type", "application/json")
+func dynamicsLinePayload(po PurchaseOrder, line PurchaseOrderLine) map[string]interface{} {
+	payload := map[string]interface{}{
+		"PurchaseOrderNumber":     po.ID,
+		"LineNumber":              line.LineNumber,
+		"ItemNumber":              line.ItemNumber,
+		"LineDescription":         line.Description,
+		"OrderedPurchaseQuantity": jsonDecimal(line.Quantity),
+		"PurchaseUnitSymbol":      line.Unit,
+		"PurchasePrice":           jsonDecimal(line.UnitPrice),
+		"LineAmount":              moneyJSON(line.LineAmount, po.Currency),
+		"ReceivingSiteId":         line.Site,
+		"ReceivingWarehouseId":    line.Warehouse,
+	}
+	if line.DeliveryDate != nil {
+		payload["RequestedDeliveryDate"] = line.DeliveryDate.UTC().Format(time.RFC3339)
+	}
+	return payload
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// sendDynamicsEntity sends payload, if any, to an entity set or record with
+// the extra request headers and returns the response, whose body the caller
+// must close, when Dynamics answers with a 2xx status.
+func sendDynamicsEntity(ctx context.Context, method, url string, header http.Header, payload map[string]interface{}) (*http.Response, error) {
+	var jsonPayload []byte
+	if payload != nil {
+		jsonPayload, _ = json.Marshal(payload)
+	}
+	resp, err := doDynamicsRequest(ctx, method, url, header, jsonPayload)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &DynamicsAPIError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// dynamicsEntity is a header or line record returned by an entity set query.
+type dynamicsEntity struct {
+	ODataID             string `json:"@odata.id"`
+	ETag                string `json:"@odata.etag"`
+	DataAreaID          string `json:"dataAreaId"`
+	PurchaseOrderNumber string `json:"PurchaseOrderNumber"`
+	LineNumber          int    `json:"LineNumber"`
+}
+
+// headerKey returns the record key, taken from "@odata.id" when Dynamics
+// includes it and built from the header key fields otherwise.
+func (e dynamicsEntity) headerKey() string {
+	if key := entityKey(e.ODataID); key != "" {
+		return key
+	}
+	return fmt.Sprintf("dataAreaId='%s',PurchaseOrderNumber='%s'", e.DataAreaID, odataString(e.PurchaseOrderNumber))
+}
+
+func (e dynamicsEntity) lineKey() string {
+	if key := entityKey(e.ODataID); key != "" {
+		return key
+	}
+	return fmt.Sprintf("dataAreaId='%s',PurchaseOrderNumber='%s',LineNumber=%d", e.DataAreaID, odataString(e.PurchaseOrderNumber), e.LineNumber)
+}
+
+// findDynamicsEntities returns the records of an entity set that belong to
+// the purchase order.
+func findDynamicsEntities(ctx context.Context, setURL, poID string) ([]dynamicsEntity, error) {
+	filter := fmt.Sprintf("PurchaseOrderNumber eq '%s'", odataString(poID))
+	resp, err := doDynamicsRequest(ctx, "GET", setURL+"?"+url.Values{"$filter": {filter}}.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("dynamics API Error: %s", resp.Status)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &DynamicsAPIError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	return nil
+	var body struct {
+		Value []dynamicsEntity `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", setURL, err)
+	}
+	return body.Value, nil
+}
+
+// dynamicsEntityURL addresses a single record of an entity set by its key.
+func dynamicsEntityURL(setURL, key string) string {
+	return setURL + "(" + key + ")"
+}
+
+// odataString escapes a value for use inside a quoted OData string literal.
+func odataString(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+// dynamicsLinesURL returns the configured lines entity set, defaulting to
+// PurchaseOrderLinesV2 next to the header entity set.
+func dynamicsLinesURL(cfg Dynamics365Config) (string, error) {
+	if cfg.LinesURL != "" {
+		return cfg.LinesURL, nil
+	}
+
+	apiURL, err := url.Parse(cfg.APIURL)
+	if err != nil || apiURL.Host == "" {
+		return "", fmt.Errorf("dynamics365: cannot derive lines URL from API URL %q", cfg.APIURL)
+	}
+	return apiURL.ResolveReference(&url.URL{Path: "PurchaseOrderLinesV2"}).String(), nil
+}
+
+// doDynamicsRequest sends a JSON request with the extra headers, if any, to
+// Dynamics, attaching a bearer token when a token source is configured. A 401
+// usually means the cached token was revoked or rotated early, so the token is
+// refreshed and the request retried once. Requests go through
+// dynamicsThrottle, which also retries throttled responses.
+func doDynamicsRequest(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		return sendDynamicsRequest(ctx, method, url, header, body)
+	}
+
+	resp, err := sendThrottled(ctx, send)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || dynamicsTokenSource == nil {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	dynamicsTokenSource.Invalidate()
+	return sendThrottled(ctx, send)
+}
+
+func sendDynamicsRequest(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if dynamicsTokenSource != nil {
+		token, err := dynamicsTokenSource.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{}
+	return client.Do(req)
+}
+
+// readDynamicsRecord extracts the key and ETag of a written record. Dynamics
+// reports the key in the OData-EntityId header, e.g.
+// ".../PurchPurchaseOrderHeadersV2(<key>)", and the version in the ETag
+// header; when the representation is returned in the body they are also
+// found in "@odata.id" and "@odata.etag".
+func readDynamicsRecord(resp *http.Response) dynamicsRecord {
+	entityID := resp.Header.Get("OData-EntityId")
+	etag := resp.Header.Get("ETag")
+	if entityID == "" || etag == "" {
+		var body struct {
+			ODataID string `json:"@odata.id"`
+			ETag    string `json:"@odata.etag"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+			if entityID == "" {
+				entityID = body.ODataID
+			}
+			if etag == "" {
+				etag = body.ETag
+			}
+		}
+	}
+
+	return dynamicsRecord{Key: entityKey(entityID), ETag: etag}
+}
+
+// entityKey extracts the key from a record URL such as
+// ".../PurchPurchaseOrderHeadersV2(<key>)".
+func entityKey(entityID string) string {
+	start := strings.LastIndex(entityID, "(")
+	if start == -1 || !strings.HasSuffix(entityID, ")") {
+		return ""
+	}
+	return entityID[start+1 : len(entityID)-1]
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Resolutions of a sync conflict.
+const (
+	// ConflictOverwrite sends our version of the order to Dynamics again,
+	// replacing the edits made there.
+	ConflictOverwrite = "overwrite"
+	// ConflictKeep leaves the order as it was edited in Dynamics.
+	ConflictKeep = "keep"
+)
+
+var errConflictNotFound = errors.New("no unresolved conflict with that ID")
+
+// SyncConflict is an update Dynamics rejected because the order had been
+// edited there since it was last synced.
+type SyncConflict struct {
+	ID              int64
+	PurchaseOrderID string
+	SyncVersion     int64
+	DynamicsID      string
+	ExpectedETag    string
+	CurrentETag     string
+	DetectedAt      time.Time
+}
+
+// RecordSyncConflict stores the rejected update together with the order as we
+// tried to send it, and marks the order as in conflict unless a newer change
+// to it is already pending.
+func RecordSyncConflict(ctx context.Context, po PurchaseOrder, conflict *DynamicsConflictError) error {
+	payload, err := json.Marshal(po)
+	if err != nil {
+		return err
+	}
+	var lineETags []byte
+	if conflict.CurrentLines != nil {
+		if lineETags, err = json.Marshal(conflict.CurrentLines); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO sync_conflicts (purchase_order_id, sync_version, message_id, dynamics_id, expected_etag, current_etag, current_line_etags, payload)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7, $8)`,
+		po.ID, po.Version, po.MessageID, conflict.DynamicsID, conflict.ExpectedETag, conflict.CurrentETag, lineETags, payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE purchase_orders SET sync_status = CASE WHEN sync_status = 'pending' THEN sync_status ELSE $2 END, sync_error = $3 WHERE id = $1",
+		po.ID, SyncStatusConflict, conflict.Error())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListSyncConflicts returns the conflicts still waiting for a decision, oldest
+// first.
+func ListSyncConflicts(ctx context.Context) ([]SyncConflict, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, purchase_order_id, sync_version, dynamics_id, expected_etag, COALESCE(current_etag, ''), detected_at
+		FROM sync_conflicts WHERE resolved_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []SyncConflict
+	for rows.Next() {
+		var c SyncConflict
+		if err := rows.Scan(&c.ID, &c.PurchaseOrderID, &c.SyncVersion, &c.DynamicsID, &c.ExpectedETag, &c.CurrentETag, &c.DetectedAt); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+// ResolveSyncConflict closes the conflict and adopts the ETags Dynamics had for
+// the header and its lines when it was detected. With ConflictOverwrite the order is put back to pending as
+// an update, so our version is sent again; with ConflictKeep it is marked
+// synced as it stands in Dynamics. Either way a newer change that is already
+// pending is left to be sent as usual.
+func ResolveSyncConflict(ctx context.Context, id int64, resolution string) error {
+	var resolve string
+	switch resolution {
+	case ConflictOverwrite:
+		resolve = `UPDATE purchase_orders SET sync_status = 'pending', sync_action = 'update', sync_version = sync_version + 1, sync_error = NULL
+			WHERE id = $1 AND sync_status = 'conflict'`
+	case ConflictKeep:
+		resolve = "UPDATE purchase_orders SET sync_status = 'synced', sync_error = NULL WHERE id = $1 AND sync_status = 'conflict'"
+	default:
+		return fmt.Errorf("unknown resolution %q, expected %s or %s", resolution, ConflictOverwrite, ConflictKeep)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var poID string
+	var currentETag sql.NullString
+	var lineETags []byte
+	err = tx.QueryRowContext(ctx, `UPDATE sync_conflicts SET resolved_at = NOW(), resolution = $2
+		WHERE id = $1 AND resolved_at IS NULL RETURNING purchase_order_id, current_etag, current_line_etags`, id, resolution).Scan(&poID, &currentETag, &lineETags)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errConflictNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE purchase_orders SET dynamics_etag = $2 WHERE id = $1", poID, currentETag); err != nil {
+		return err
+	}
+	// unread lines keep their stored ETags, and the next sync detects them again
+	if lineETags != nil {
+		if err := saveDynamicsLines(ctx, tx, poID, lineETags); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, resolve, poID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runConflictsCommand implements "dynaproc conflicts list|resolve <id> overwrite|keep".
+func runConflictsCommand(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: dynaproc conflicts list|resolve <id> overwrite|keep")
+	}
+
+	switch args[0] {
+	case "list":
+		conflicts, err := ListSyncConflicts(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tORDER\tVERSION\tDYNAMICS ID\tDETECTED AT")
+		for _, c := range conflicts {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", c.ID, c.PurchaseOrderID, c.SyncVersion, c.DynamicsID, c.DetectedAt.UTC().Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "resolve":
+		if len(args) != 3 {
+			return errors.New("usage: dynaproc conflicts resolve <id> overwrite|keep")
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid conflict ID %q", args[1])
+		}
+		if err := ResolveSyncConflict(ctx, id, args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "resolved conflict %d (%s)\n", id, args[2])
+		return nil
+	default:
+		return fmt.Errorf("unknown conflicts command %q, expected list or resolve", args[0])
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordSyncConflict(t *testing.T) {
+	po := PurchaseOrder{ID: "PO001", VendorID: "V001", Version: 3}
+	conflict := &DynamicsConflictError{DynamicsID: "DYN-001", ExpectedETag: `W/"1"`, CurrentETag: `W/"2"`, CurrentLines: map[int]string{1: `W/"4"`}}
+
+	// Test case 1: The conflict is stored and the order held in one transaction
+	t.Run("Record conflict", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO sync_conflicts").
+			WithArgs("PO001", int64(3), "", "DYN-001", `W/"1"`, `W/"2"`, []byte(`{"1":"W/\"4\""}`), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status = CASE WHEN sync_status = 'pending' THEN sync_status ELSE \\$2 END, sync_error = \\$3").
+			WithArgs("PO001", SyncStatusConflict, conflict.Error()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		assert.NoError(t, RecordSyncConflict(context.Background(), po, conflict))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: A failure leaves neither the conflict nor the status behind
+	t.Run("Rollback on failure", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO sync_conflicts").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+
+		assert.Error(t, RecordSyncConflict(context.Background(), po, conflict))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestResolveSyncConflict(t *testing.T) {
+	expectResolve := func(mock sqlmock.Sqlmock, resolution string) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("UPDATE sync_conflicts SET resolved_at = NOW\\(\\), resolution = \\$2").
+			WithArgs(int64(7), resolution).
+			WillReturnRows(sqlmock.NewRows([]string{"purchase_order_id", "current_etag", "current_line_etags"}).
+				AddRow("PO001", `W/"2"`, []byte(`{"1":"W/\"4\""}`)))
+		mock.ExpectExec("UPDATE purchase_orders SET dynamics_etag = \\$2 WHERE id = \\$1").
+			WithArgs("PO001", `W/"2"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO001", `{"1":"W/\"4\""}`)
+	}
+
+	// Test case 1: Our version is queued again as an update
+	t.Run("Overwrite", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectResolve(mock, ConflictOverwrite)
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status = 'pending', sync_action = 'update', sync_version = sync_version \\+ 1").
+			WithArgs("PO001").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		assert.NoError(t, ResolveSyncConflict(context.Background(), 7, ConflictOverwrite))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: The version in Dynamics is accepted
+	t.Run("Keep", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectResolve(mock, ConflictKeep)
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status = 'synced', sync_error = NULL").
+			WithArgs("PO001").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		assert.NoError(t, ResolveSyncConflict(context.Background(), 7, ConflictKeep))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 3: Unknown or already resolved conflicts
+	t.Run("Conflict not found", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery("UPDATE sync_conflicts").
+			WillReturnRows(sqlmock.NewRows([]string{"purchase_order_id", "current_etag"}))
+		mock.ExpectRollback()
+
+		err := ResolveSyncConflict(context.Background(), 7, ConflictKeep)
+		assert.ErrorIs(t, err, errConflictNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 4: Unknown resolutions are rejected before touching the database
+	t.Run("Unknown resolution", func(t *testing.T) {
+		mock := setupMockDB(t)
+		assert.ErrorContains(t, ResolveSyncConflict(context.Background(), 7, "merge"), "unknown resolution")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 5: Line ETags that could not be read leave the stored ones alone
+	t.Run("Lines not read", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery("UPDATE sync_conflicts").
+			WillReturnRows(sqlmock.NewRows([]string{"purchase_order_id", "current_etag", "current_line_etags"}).AddRow("PO001", `W/"2"`, nil))
+		mock.ExpectExec("UPDATE purchase_orders SET dynamics_etag").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status = 'synced'").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		assert.NoError(t, ResolveSyncConflict(context.Background(), 7, ConflictKeep))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRunConflictsCommand(t *testing.T) {
+	// Test case 1: List unresolved conflicts
+	t.Run("List", func(t *testing.T) {
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT id, purchase_order_id, sync_version, dynamics_id, expected_etag").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "purchase_order_id", "sync_version", "dynamics_id", "expected_etag", "current_etag", "detected_at"}).
+				AddRow(7, "PO001", 3, "DYN-001", `W/"1"`, `W/"2"`, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)))
+
+		var out bytes.Buffer
+		err := runConflictsCommand(context.Background(), []string{"list"}, &out)
+		assert.NoError(t, err)
+		assert.Regexp(t, `7\s+PO001\s+3\s+DYN-001\s+2024-05-01T10:00:00Z`, out.String())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 2: Invalid arguments
+	t.Run("Invalid arguments", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.ErrorContains(t, runConflictsCommand(context.Background(), nil, &out), "usage")
+		assert.ErrorContains(t, runConflictsCommand(context.Background(), []string{"ignore"}, &out), "unknown conflicts command")
+		assert.ErrorContains(t, runConflictsCommand(context.Background(), []string{"resolve", "7"}, &out), "usage")
+		assert.ErrorContains(t, runConflictsCommand(context.Background(), []string{"resolve", "seven", "keep"}, &out), "invalid conflict ID")
+	})
+}
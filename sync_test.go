@@ -1,19 +1,43 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
+// serveLookup answers the Dynamics lookup of an order's header or lines with
+// the given records and reports whether r was such a lookup.
+func serveLookup(w http.ResponseWriter, r *http.Request, records ...dynamicsEntity) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if records == nil {
+		records = []dynamicsEntity{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"value": records})
+	return true
+}
+
 func TestSyncToDynamics(t *testing.T) {
 	// Test case 1: Successful sync
 	t.Run("Successfully sync purchase order", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
 			assert.Equal(t, "POST", r.Method)
 			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
 
@@ -27,12 +51,20 @@ func TestSyncToDynamics(t *testing.T) {
 			assert.Equal(t, "PO123", payload["PurchaseOrderNumber"])
 			assert.Equal(t, "V001", payload["VendorAccountNumber"])
 			assert.Equal(t, 100.50, payload["TotalAmount"])
+			assert.Contains(t, string(body), `"TotalAmount":100.50`)
 			assert.Equal(t, "USD", payload["Currency"])
 
-			w.WriteHeader(http.StatusOK)
+			w.Header().Set("OData-EntityId", "https://dynamics.example.com/data/PurchPurchaseOrderHeadersV2(dataAreaId='usmf',PurchaseOrderNumber='PO123')")
+			w.WriteHeader(http.StatusNoContent)
 		}))
 		defer server.Close()
 
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		cfg := Config{
 			Dynamics365: Dynamics365Config{
 				APIURL: server.URL,
@@ -42,22 +74,32 @@ func TestSyncToDynamics(t *testing.T) {
 		po := PurchaseOrder{
 			ID:       "PO123",
 			VendorID: "V001",
-			Amount:   100.50,
+			Amount:   decimal.RequireFromString("100.50"),
 			Currency: "USD",
 		}
 
-		err := SyncToDynamics(cfg, po)
+		err := SyncToDynamics(context.Background(), cfg, po)
 		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
 	// Test case 2: Server error response
 	t.Run("Server returns error", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Internal Server Error"))
 		}))
 		defer server.Close()
 
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, "dynamics API Error: 500 Internal Server Error", "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		cfg := Config{
 			Dynamics365: Dynamics365Config{
 				APIURL: server.URL,
@@ -67,17 +109,24 @@ func TestSyncToDynamics(t *testing.T) {
 		po := PurchaseOrder{
 			ID:       "PO123",
 			VendorID: "V001",
-			Amount:   100.50,
+			Amount:   decimal.RequireFromString("100.50"),
 			Currency: "USD",
 		}
 
-		err := SyncToDynamics(cfg, po)
+		err := SyncToDynamics(context.Background(), cfg, po)
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "500")
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
 	// Test case 3: Network error
 	t.Run("Network error", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, sqlmock.AnyArg(), "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		cfg := Config{
 			Dynamics365: Dynamics365Config{
 				APIURL: "http://invalid-url-that-does-not-exist.com",
@@ -87,23 +136,33 @@ func TestSyncToDynamics(t *testing.T) {
 		po := PurchaseOrder{
 			ID:       "PO123",
 			VendorID: "V001",
-			Amount:   100.50,
+			Amount:   decimal.RequireFromString("100.50"),
 			Currency: "USD",
 		}
 
-		err := SyncToDynamics(cfg, po)
+		err := SyncToDynamics(context.Background(), cfg, po)
 		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
 	// Test case 4: Invalid JSON response
 	t.Run("Server returns invalid JSON", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("invalid json"))
 		}))
 		defer server.Close()
 
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		cfg := Config{
 			Dynamics365: Dynamics365Config{
 				APIURL: server.URL,
@@ -113,16 +172,23 @@ func TestSyncToDynamics(t *testing.T) {
 		po := PurchaseOrder{
 			ID:       "PO123",
 			VendorID: "V001",
-			Amount:   100.50,
+			Amount:   decimal.RequireFromString("100.50"),
 			Currency: "USD",
 		}
 
-		err := SyncToDynamics(cfg, po)
+		err := SyncToDynamics(context.Background(), cfg, po)
 		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
 	// Test case 5: Empty API URL
 	t.Run("Empty API URL", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, sqlmock.AnyArg(), "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		cfg := Config{
 			Dynamics365: Dynamics365Config{
 				APIURL: "",
@@ -132,16 +198,23 @@ func TestSyncToDynamics(t *testing.T) {
 		po := PurchaseOrder{
 			ID:       "PO123",
 			VendorID: "V001",
-			Amount:   100.50,
+			Amount:   decimal.RequireFromString("100.50"),
 			Currency: "USD",
 		}
 
-		err := SyncToDynamics(cfg, po)
+		err := SyncToDynamics(context.Background(), cfg, po)
 		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
 	// Test case 6: Malformed URL
 	t.Run("Malformed URL", func(t *testing.T) {
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, sqlmock.AnyArg(), "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		cfg := Config{
 			Dynamics365: Dynamics365Config{
 				APIURL: "not-a-valid-url",
@@ -151,11 +224,808 @@ func TestSyncToDynamics(t *testing.T) {
 		po := PurchaseOrder{
 			ID:       "PO123",
 			VendorID: "V001",
-			Amount:   100.50,
+			Amount:   decimal.RequireFromString("100.50"),
 			Currency: "USD",
 		}
 
-		err := SyncToDynamics(cfg, po)
+		err := SyncToDynamics(context.Background(), cfg, po)
 		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
+
+	// Test case 7: Sync state cannot be recorded
+	t.Run("Mark syncing fails", func(t *testing.T) {
+		requestReceived := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			requestReceived = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		mock.ExpectQuery("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSyncing, sqlmock.AnyArg()).
+			WillReturnError(sql.ErrConnDone)
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL: server.URL,
+			},
+		}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123"})
+		assert.Error(t, err)
+		assert.False(t, requestReceived, "Dynamics must not be called when the sync state cannot be recorded")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 8: Bearer token is attached and refreshed once on 401
+	t.Run("Retry once with a fresh token on 401", func(t *testing.T) {
+		tokenServer, tokenCalls := newTokenServer(t, 3600, nil)
+
+		var authHeaders []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+			if len(authHeaders) == 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		ts, err := NewTokenSource(Dynamics365Config{
+			ClientID:     "client-1",
+			ClientSecret: "secret",
+			Scope:        "https://api.example.com/.default",
+			TokenURL:     tokenServer.URL,
+		})
+		assert.NoError(t, err)
+		originalTokenSource := dynamicsTokenSource
+		dynamicsTokenSource = ts
+		defer func() { dynamicsTokenSource = originalTokenSource }()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL: server.URL,
+			},
+		}
+
+		err = SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, authHeaders)
+		assert.Equal(t, int32(2), atomic.LoadInt32(tokenCalls))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 9: Lines are posted after the header
+	t.Run("Post lines after the header", func(t *testing.T) {
+		var paths []string
+		var linePayloads []map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			paths = append(paths, r.URL.Path)
+			if r.URL.Path == "/data/PurchaseOrderLinesV2" {
+				var payload map[string]interface{}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+				linePayloads = append(linePayloads, payload)
+			}
+			w.Header().Set("ETag", `W/"1"`)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "", `W/"1"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO123", `{"1":"W/\"1\"","2":"W/\"1\""}`)
+		mock.ExpectCommit()
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL: server.URL + "/data/PurchPurchaseOrderHeadersV2",
+			},
+		}
+
+		deliveryDate := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+		po := PurchaseOrder{
+			ID:       "PO123",
+			VendorID: "V001",
+			Amount:   decimal.RequireFromString("100.50"),
+			Currency: "USD",
+			Lines: []PurchaseOrderLine{
+				{LineNumber: 1, ItemNumber: "ITEM-1", Description: "Bolts", Quantity: decimal.NewFromInt(10), Unit: "pcs", UnitPrice: decimal.RequireFromString("5.00"), LineAmount: decimal.RequireFromString("50.00"), DeliveryDate: &deliveryDate, Site: "1", Warehouse: "11"},
+				{LineNumber: 2, ItemNumber: "ITEM-2", Quantity: decimal.NewFromInt(1), Unit: "ea", UnitPrice: decimal.RequireFromString("50.50"), LineAmount: decimal.RequireFromString("50.50")},
+			},
+		}
+
+		err := SyncToDynamics(context.Background(), cfg, po)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/data/PurchPurchaseOrderHeadersV2", "/data/PurchaseOrderLinesV2", "/data/PurchaseOrderLinesV2"}, paths)
+		if assert.Len(t, linePayloads, 2) {
+			assert.Equal(t, "PO123", linePayloads[0]["PurchaseOrderNumber"])
+			assert.Equal(t, float64(1), linePayloads[0]["LineNumber"])
+			assert.Equal(t, "ITEM-1", linePayloads[0]["ItemNumber"])
+			assert.Equal(t, "Bolts", linePayloads[0]["LineDescription"])
+			assert.Equal(t, float64(10), linePayloads[0]["OrderedPurchaseQuantity"])
+			assert.Equal(t, "pcs", linePayloads[0]["PurchaseUnitSymbol"])
+			assert.Equal(t, float64(5), linePayloads[0]["PurchasePrice"])
+			assert.Equal(t, float64(50), linePayloads[0]["LineAmount"])
+			assert.Equal(t, "2024-05-01T00:00:00Z", linePayloads[0]["RequestedDeliveryDate"])
+			assert.Equal(t, "1", linePayloads[0]["ReceivingSiteId"])
+			assert.Equal(t, "11", linePayloads[0]["ReceivingWarehouseId"])
+			assert.NotContains(t, linePayloads[1], "RequestedDeliveryDate")
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 10: A rejected line fails the sync, keeping the header that was written
+	t.Run("Line rejected", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			if r.URL.Path == "/lines" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("OData-EntityId", "https://dynamics.example.com/data/PurchPurchaseOrderHeadersV2(DYN-123)")
+			w.Header().Set("ETag", `W/"1"`)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, "post line 1: dynamics API Error: 400 Bad Request", "DYN-123", `W/"1"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO123", "{}")
+		mock.ExpectCommit()
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL:   server.URL + "/headers",
+				LinesURL: server.URL + "/lines",
+			},
+		}
+
+		po := PurchaseOrder{ID: "PO123", Lines: []PurchaseOrderLine{{LineNumber: 1, ItemNumber: "ITEM-1"}}}
+		err := SyncToDynamics(context.Background(), cfg, po)
+
+		var apiErr *DynamicsAPIError
+		assert.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 11: An order already in Dynamics is found by number and patched
+	t.Run("Patch order found by number", func(t *testing.T) {
+		var requests []string
+		var headerPatch map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/headers":
+				assert.Equal(t, "PurchaseOrderNumber eq 'PO123'", r.URL.Query().Get("$filter"))
+				serveLookup(w, r, dynamicsEntity{ETag: `W/"1"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123"})
+			case r.Method == "GET" && r.URL.Path == "/lines":
+				serveLookup(w, r, dynamicsEntity{ODataID: "https://d365.example.com/lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=1)", ETag: `W/"5"`, LineNumber: 1})
+			case r.Method == "PATCH" && r.URL.Path == "/headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')":
+				assert.Equal(t, `W/"1"`, r.Header.Get("If-Match"))
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&headerPatch))
+				w.Header().Set("ETag", `W/"2"`)
+				w.WriteHeader(http.StatusNoContent)
+			case r.Method == "PATCH":
+				assert.Equal(t, `W/"5"`, r.Header.Get("If-Match"))
+				w.Header().Set("ETag", `W/"6"`)
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.Header().Set("ETag", `W/"7"`)
+				w.WriteHeader(http.StatusCreated)
+			}
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"2"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO123", `{"1":"W/\"6\"","2":"W/\"7\""}`)
+		mock.ExpectCommit()
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL:   server.URL + "/headers",
+				LinesURL: server.URL + "/lines",
+			},
+		}
+
+		po := PurchaseOrder{
+			ID:       "PO123",
+			VendorID: "V001",
+			Amount:   decimal.RequireFromString("100.50"),
+			Currency: "USD",
+			Lines:    []PurchaseOrderLine{{LineNumber: 1, ItemNumber: "ITEM-1"}, {LineNumber: 2, ItemNumber: "ITEM-2"}},
+		}
+
+		err := SyncToDynamics(context.Background(), cfg, po)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"GET /headers",
+			"GET /lines",
+			"PATCH /headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')",
+			"PATCH /lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=1)",
+			"POST /lines",
+		}, requests)
+		assert.Equal(t, "V001", headerPatch["VendorAccountNumber"])
+		assert.NotContains(t, headerPatch, "PurchaseOrderNumber")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 12: A stored Dynamics key is patched without a lookup
+	t.Run("Patch stored key", func(t *testing.T) {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if serveLookup(w, r) {
+				return
+			}
+			w.Header().Set("ETag", `W/"2"`)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncingETag(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`)
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"2"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO123", "{}")
+		mock.ExpectCommit()
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL:   server.URL + "/headers",
+				LinesURL: server.URL + "/lines",
+			},
+		}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"GET /lines", "PATCH /headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')"}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 13: A message in the ledger is not synced again
+	t.Run("Skip processed message", func(t *testing.T) {
+		requestReceived := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestReceived = true
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM processed_messages").
+			WithArgs("msg-1").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", MessageID: "msg-1"})
+		assert.ErrorIs(t, err, errAlreadyProcessed)
+		assert.False(t, requestReceived, "Dynamics must not be called for a processed message")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 14: A synced message is added to the ledger
+	t.Run("Record processed message", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM processed_messages").
+			WithArgs("msg-2").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO processed_messages").
+			WithArgs("msg-2", "PO123").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", MessageID: "msg-2"})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 15: Lines removed from an amended order are deleted, each against its ETag
+	t.Run("Delete removed lines", func(t *testing.T) {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch {
+			case r.Method == "GET":
+				serveLookup(w, r,
+					dynamicsEntity{ETag: `W/"3"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123", LineNumber: 1},
+					dynamicsEntity{ETag: `W/"4"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123", LineNumber: 2})
+				return
+			case r.URL.Path == "/lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=1)":
+				assert.Equal(t, `W/"3"`, r.Header.Get("If-Match"))
+			case r.URL.Path == "/lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=2)":
+				assert.Equal(t, `W/"4"`, r.Header.Get("If-Match"))
+			}
+			w.Header().Set("ETag", `W/"2"`)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncingLines(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`, map[int]string{1: `W/"3"`, 2: `W/"4"`})
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"2"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO123", `{"1":"W/\"2\""}`)
+		mock.ExpectCommit()
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL:   server.URL + "/headers",
+				LinesURL: server.URL + "/lines",
+			},
+		}
+
+		po := PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 3, Lines: []PurchaseOrderLine{{LineNumber: 1, ItemNumber: "ITEM-1"}}}
+		err := SyncToDynamics(context.Background(), cfg, po)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"GET /lines",
+			"PATCH /headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')",
+			"PATCH /lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=1)",
+			"DELETE /lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=2)",
+		}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 16: A cancelled order invokes the cancellation action
+	t.Run("Cancel order", func(t *testing.T) {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if serveLookup(w, r, dynamicsEntity{DataAreaID: "usmf", PurchaseOrderNumber: "PO123"}) {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionCancel, Version: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"GET /headers",
+			"POST /headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')/" + defaultCancelAction,
+		}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 17: An order that never reached Dynamics has nothing to cancel
+	t.Run("Cancel order not in Dynamics", func(t *testing.T) {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if serveLookup(w, r) {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionCancel, Version: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"GET /headers"}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 18: An event overtaken by a newer change is skipped
+	t.Run("Skip stale event", func(t *testing.T) {
+		requestReceived := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestReceived = true
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		mock.ExpectQuery(markSyncingQuery).
+			WithArgs("PO123", SyncStatusSyncing, int64(2)).
+			WillReturnRows(sqlmock.NewRows([]string{"dynamics_id", "dynamics_etag"}))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2})
+		assert.ErrorIs(t, err, errStaleEvent)
+		assert.False(t, requestReceived, "Dynamics must not be called for a stale event")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 19: The ETag of a created order is stored
+	t.Run("Store ETag of created order", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			assert.Equal(t, "return=representation", r.Header.Get("Prefer"))
+			assert.Empty(t, r.Header.Get("If-Match"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"@odata.id":"https://d365.example.com/headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')","@odata.etag":"W/\"1\""}`))
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123"})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 20: Updates are sent with the stored ETag and the new one is kept
+	t.Run("Patch with If-Match", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			assert.Equal(t, "PATCH", r.Method)
+			assert.Equal(t, `W/"1"`, r.Header.Get("If-Match"))
+			w.Header().Set("ETag", `W/"2"`)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncingETag(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`)
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"2"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectSaveLines(mock, "PO123", "{}")
+		mock.ExpectCommit()
+
+		cfg := Config{
+			Dynamics365: Dynamics365Config{
+				APIURL:   server.URL + "/headers",
+				LinesURL: server.URL + "/lines",
+			},
+		}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 21: An order edited in Dynamics is recorded as a conflict instead of failing
+	t.Run("Conflict on precondition failed", func(t *testing.T) {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if r.URL.Path == "/headers" && serveLookup(w, r, dynamicsEntity{DataAreaID: "usmf", PurchaseOrderNumber: "PO123", ETag: `W/"7"`}) {
+				return
+			}
+			if serveLookup(w, r) {
+				return
+			}
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM processed_messages").
+			WithArgs("msg-3").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		expectMarkSyncingETag(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`)
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO sync_conflicts").
+			WithArgs("PO123", int64(2), "msg-3", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`, `W/"7"`, []byte("{}"), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusConflict, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		po := PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2, MessageID: "msg-3"}
+		err := SyncToDynamics(context.Background(), cfg, po)
+
+		var conflict *DynamicsConflictError
+		assert.ErrorAs(t, err, &conflict)
+		assert.Equal(t, `W/"7"`, conflict.CurrentETag)
+		assert.Equal(t, []string{
+			"GET /PurchaseOrderLinesV2",
+			"PATCH /headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')",
+			"GET /headers",
+			"GET /PurchaseOrderLinesV2",
+		}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 22: A conflict that cannot be recorded fails the sync so it is retried
+	t.Run("Conflict not recorded", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveLookup(w, r) {
+				return
+			}
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncingETag(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`)
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO sync_conflicts").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, sqlmock.AnyArg(), "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2})
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		var conflict *DynamicsConflictError
+		assert.False(t, errors.As(err, &conflict), "an unrecorded conflict must not be acknowledged")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 23: An order synced before ETags were stored is a conflict, not patched against its current ETag
+	t.Run("Conflict without a stored ETag", func(t *testing.T) {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if r.URL.Path == "/headers" && serveLookup(w, r, dynamicsEntity{ETag: `W/"5"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123"}) {
+				return
+			}
+			if serveLookup(w, r) {
+				return
+			}
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'")
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO sync_conflicts").
+			WithArgs("PO123", int64(2), "", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", "", `W/"5"`, []byte("{}"), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusConflict, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2})
+		var conflict *DynamicsConflictError
+		assert.ErrorAs(t, err, &conflict)
+		assert.Equal(t, []string{"GET /PurchaseOrderLinesV2", "GET /headers", "GET /PurchaseOrderLinesV2"}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 24: An order found in Dynamics without an ETag is not patched at all
+	t.Run("Refuse to patch without an ETag", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/headers" && serveLookup(w, r, dynamicsEntity{DataAreaID: "usmf", PurchaseOrderNumber: "PO123"}) {
+				return
+			}
+			if serveLookup(w, r) {
+				return
+			}
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusFailed, sqlmock.AnyArg(), "", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2})
+		assert.ErrorIs(t, err, errMissingETag)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test case 25: A write response without an ETag is followed by reading the header back
+	t.Run("Read back a missing ETag", func(t *testing.T) {
+		var requests []string
+		created := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if created && serveLookup(w, r, dynamicsEntity{ETag: `W/"1"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123"}) {
+				return
+			}
+			if serveLookup(w, r) {
+				return
+			}
+			created = true
+			w.Header().Set("OData-EntityId", "https://d365.example.com/headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')")
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		mock := setupMockDB(t)
+		expectMarkSyncing(mock, "PO123", "")
+		mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+			WithArgs("PO123", SyncStatusSynced, "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		cfg := Config{Dynamics365: Dynamics365Config{APIURL: server.URL + "/headers"}}
+
+		err := SyncToDynamics(context.Background(), cfg, PurchaseOrder{ID: "PO123"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"GET /headers", "POST /headers", "GET /headers"}, requests)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// Test cases 26-28: Lines edited, added or changed in Dynamics are conflicts, not overwritten or deleted
+	lineConflicts := []struct {
+		name     string
+		stored   map[int]string
+		lines    []dynamicsEntity
+		writes   []string
+		header   string
+		expected []byte
+	}{
+		{
+			name:     "Line edited in Dynamics",
+			stored:   map[int]string{1: `W/"3"`},
+			lines:    []dynamicsEntity{{ETag: `W/"9"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123", LineNumber: 1}},
+			header:   `W/"1"`,
+			expected: []byte(`{"1":"W/\"9\""}`),
+		},
+		{
+			name:   "Line added in Dynamics",
+			stored: map[int]string{1: `W/"3"`},
+			lines: []dynamicsEntity{
+				{ETag: `W/"3"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123", LineNumber: 1},
+				{ETag: `W/"1"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123", LineNumber: 2},
+			},
+			header:   `W/"1"`,
+			expected: []byte(`{"1":"W/\"3\"","2":"W/\"1\""}`),
+		},
+		{
+			name:     "Line changed during the sync",
+			stored:   map[int]string{1: `W/"3"`},
+			lines:    []dynamicsEntity{{ETag: `W/"3"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123", LineNumber: 1}},
+			writes:   []string{"PATCH /headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')", "PATCH /lines(dataAreaId='usmf',PurchaseOrderNumber='PO123',LineNumber=1)"},
+			header:   `W/"2"`,
+			expected: []byte(`{"1":"W/\"3\""}`),
+		},
+	}
+	for _, tc := range lineConflicts {
+		t.Run(tc.name, func(t *testing.T) {
+			var writes []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/headers" && serveLookup(w, r, dynamicsEntity{ETag: `W/"1"`, DataAreaID: "usmf", PurchaseOrderNumber: "PO123"}):
+				case r.URL.Path == "/lines" && serveLookup(w, r, tc.lines...):
+				case r.URL.Path == "/headers(dataAreaId='usmf',PurchaseOrderNumber='PO123')":
+					writes = append(writes, r.Method+" "+r.URL.Path)
+					w.Header().Set("ETag", `W/"2"`)
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					writes = append(writes, r.Method+" "+r.URL.Path)
+					w.WriteHeader(http.StatusPreconditionFailed)
+				}
+			}))
+			defer server.Close()
+
+			mock := setupMockDB(t)
+			expectMarkSyncingLines(mock, "PO123", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", `W/"1"`, tc.stored)
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO sync_conflicts").
+				WithArgs("PO123", int64(2), "", "dataAreaId='usmf',PurchaseOrderNumber='PO123'", tc.header, `W/"1"`, tc.expected, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("UPDATE purchase_orders SET sync_status").
+				WithArgs("PO123", SyncStatusConflict, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			cfg := Config{
+				Dynamics365: Dynamics365Config{
+					APIURL:   server.URL + "/headers",
+					LinesURL: server.URL + "/lines",
+				},
+			}
+
+			po := PurchaseOrder{ID: "PO123", Action: SyncActionUpdate, Version: 2, Lines: []PurchaseOrderLine{{LineNumber: 1, ItemNumber: "ITEM-1"}}}
+			err := SyncToDynamics(context.Background(), cfg, po)
+
+			var conflict *DynamicsConflictError
+			assert.ErrorAs(t, err, &conflict)
+			assert.Equal(t, tc.writes, writes)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDynamicsLinesURL(t *testing.T) {
+	linesURL, err := dynamicsLinesURL(Dynamics365Config{APIURL: "https://d365.example.com/data/PurchPurchaseOrderHeadersV2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://d365.example.com/data/PurchaseOrderLinesV2", linesURL)
+
+	linesURL, err = dynamicsLinesURL(Dynamics365Config{APIURL: "https://d365.example.com/data/PurchPurchaseOrderHeadersV2", LinesURL: "https://lines.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://lines.example.com", linesURL)
+
+	_, err = dynamicsLinesURL(Dynamics365Config{APIURL: "not-a-valid-url"})
+	assert.Error(t, err)
+}
+
+func TestFindDynamicsEntities(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PurchaseOrderNumber eq 'PO+1&2''s'", r.URL.Query().Get("$filter"))
+		assert.Len(t, r.URL.Query(), 1)
+		serveLookup(w, r, dynamicsEntity{DataAreaID: "usmf", PurchaseOrderNumber: "PO+1&2's"})
+	}))
+	defer server.Close()
+
+	// reserved query characters in the order number stay part of the filter
+	entities, err := findDynamicsEntities(context.Background(), server.URL+"/headers", "PO+1&2's")
+	assert.NoError(t, err)
+	assert.Len(t, entities, 1)
 }